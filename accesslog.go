@@ -0,0 +1,346 @@
+package nix
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nixpare/logger/v3"
+	"github.com/nixpare/nix/utility"
+)
+
+// AccessRecord holds every information about a served request
+// provided to an AccessLogger
+type AccessRecord struct {
+	Time       time.Time
+	Method     string
+	URI        string
+	Host       string
+	CustomHost string
+	Proto      string
+	Secure     bool
+	Status     int
+	Written    int64
+	Duration   time.Duration
+	RemoteAddr string
+	User       string
+	UserAgent  string
+	Referer    string
+	// Internal holds the internal messages added to the Context
+	Internal []string
+	// Message is the captured error message
+	Message string
+	// Panic and Stack are set only if the handler panicked
+	Panic string
+	Stack string
+}
+
+// AccessLogger logs the requests served by a Context. The logger
+// provided is the one of the Context
+type AccessLogger interface {
+	LogAccess(l *logger.Logger, rec *AccessRecord)
+}
+
+// AccessLogFormatter is an AccessLogger that formats the record in a single
+// line, logged with a level based on the status code of the response
+type AccessLogFormatter func(rec *AccessRecord) string
+
+func (f AccessLogFormatter) LogAccess(l *logger.Logger, rec *AccessRecord) {
+	line := f(rec)
+
+	switch {
+	case rec.Panic != "":
+		l.Print(logger.LOG_LEVEL_FATAL, line)
+	case rec.Status >= 500:
+		l.Print(logger.LOG_LEVEL_ERROR, line)
+	case rec.Status >= 400:
+		l.Print(logger.LOG_LEVEL_WARNING, line)
+	default:
+		l.Print(logger.LOG_LEVEL_INFO, line)
+	}
+}
+
+var (
+	// PrettyAccessLog is the default colored format
+	PrettyAccessLog AccessLogFormatter = prettyAccessLog
+	// JSONAccessLog formats the record as a JSON object
+	JSONAccessLog AccessLogFormatter = jsonAccessLog
+	// LogfmtAccessLog formats the record as logfmt key=value pairs
+	LogfmtAccessLog AccessLogFormatter = logfmtAccessLog
+	// CommonAccessLog uses the Apache Common Log Format
+	CommonAccessLog AccessLogFormatter = commonAccessLog
+	// CombinedAccessLog uses the Apache Combined Log Format
+	CombinedAccessLog AccessLogFormatter = combinedAccessLog
+)
+
+// InternalMessage returns the internal messages joined in a single string
+func (rec *AccessRecord) InternalMessage() string {
+	return CapturedError{ internal: rec.Internal }.Internal()
+}
+
+// LogHost returns the host of the request followed by the custom
+// host name, if set
+func (rec *AccessRecord) LogHost() string {
+	if rec.CustomHost == "" {
+		return rec.Host
+	}
+
+	return fmt.Sprintf("%s (%s)", rec.Host, rec.CustomHost)
+}
+
+func prettyAccessLog(rec *AccessRecord) string {
+	internal := rec.InternalMessage()
+
+	color := logger.BRIGHT_GREEN_COLOR
+	format := http_warning_format
+	switch {
+	case rec.Panic != "":
+		color, format = logger.DARK_RED_COLOR, http_panic_format
+	case rec.Status >= 500:
+		color, format = logger.DARK_RED_COLOR, http_error_format
+	case rec.Status >= 400:
+		color, format = logger.DARK_YELLOW_COLOR, http_warning_format
+	}
+
+	if rec.Status >= 400 || rec.Panic != "" {
+		if internal == "" {
+			internal = rec.Message
+		}
+	} else if len(rec.Internal) == 0 {
+		return fmt.Sprintf(http_info_format,
+			logger.BRIGHT_BLUE_COLOR, rec.RemoteAddr, logger.DEFAULT_COLOR,
+			color, rec.Status,
+			rec.Method, logger.DARK_GREEN_COLOR,
+			rec.URI, logger.DEFAULT_COLOR,
+			logger.BRIGHT_BLACK_COLOR, utility.PrintBytes(int(rec.Written)),
+			rec.Duration.Milliseconds(), logger.DEFAULT_COLOR,
+			logger.DARK_CYAN_COLOR, rec.LogHost(),
+			logger.BRIGHT_BLACK_COLOR, getProto(rec.Secure, rec.Proto), logger.DEFAULT_COLOR,
+		)
+	}
+
+	return fmt.Sprintf(format,
+		logger.BRIGHT_BLUE_COLOR, rec.RemoteAddr, logger.DEFAULT_COLOR,
+		color, rec.Status,
+		rec.Method, logger.DARK_GREEN_COLOR,
+		rec.URI, logger.DEFAULT_COLOR,
+		logger.BRIGHT_BLACK_COLOR, utility.PrintBytes(int(rec.Written)),
+		rec.Duration.Milliseconds(), logger.DEFAULT_COLOR,
+		logger.DARK_CYAN_COLOR, rec.LogHost(),
+		logger.BRIGHT_BLACK_COLOR, getProto(rec.Secure, rec.Proto), logger.DEFAULT_COLOR,
+		color, internal, logger.DEFAULT_COLOR,
+	)
+}
+
+type jsonAccessRecord struct {
+	Time       time.Time `json:"time"`
+	Method     string    `json:"method"`
+	URI        string    `json:"uri"`
+	Host       string    `json:"host"`
+	CustomHost string    `json:"custom_host,omitempty"`
+	Proto      string    `json:"proto"`
+	Secure     bool      `json:"secure"`
+	Status     int       `json:"status"`
+	Bytes      int64     `json:"bytes"`
+	DurationMs float64   `json:"duration_ms"`
+	RemoteAddr string    `json:"remote_addr"`
+	User       string    `json:"user,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	Referer    string    `json:"referer,omitempty"`
+	Internal   []string  `json:"internal,omitempty"`
+	Message    string    `json:"message,omitempty"`
+	Panic      string    `json:"panic,omitempty"`
+	Stack      string    `json:"stack,omitempty"`
+}
+
+func jsonAccessLog(rec *AccessRecord) string {
+	data, err := json.Marshal(jsonAccessRecord{
+		Time:       rec.Time,
+		Method:     rec.Method,
+		URI:        rec.URI,
+		Host:       rec.Host,
+		CustomHost: rec.CustomHost,
+		Proto:      rec.Proto,
+		Secure:     rec.Secure,
+		Status:     rec.Status,
+		Bytes:      rec.Written,
+		DurationMs: durationMs(rec.Duration),
+		RemoteAddr: rec.RemoteAddr,
+		User:       rec.User,
+		UserAgent:  rec.UserAgent,
+		Referer:    rec.Referer,
+		Internal:   rec.Internal,
+		Message:    rec.Message,
+		Panic:      rec.Panic,
+		Stack:      rec.Stack,
+	})
+	if err != nil {
+		return fmt.Sprintf(`{"error": %q}`, err.Error())
+	}
+
+	return string(data)
+}
+
+func logfmtAccessLog(rec *AccessRecord) string {
+	var sb strings.Builder
+
+	write := func(key string, value string) {
+		if sb.Len() != 0 {
+			sb.WriteByte(' ')
+		}
+		sb.WriteString(key)
+		sb.WriteByte('=')
+
+		if value == "" || strings.ContainsAny(value, " =\"\\\t\r\n") {
+			value = strconv.Quote(value)
+		}
+		sb.WriteString(value)
+	}
+
+	write("time", rec.Time.Format(time.RFC3339Nano))
+	write("method", rec.Method)
+	write("uri", rec.URI)
+	write("host", rec.Host)
+	if rec.CustomHost != "" {
+		write("custom_host", rec.CustomHost)
+	}
+	write("proto", rec.Proto)
+	write("secure", strconv.FormatBool(rec.Secure))
+	write("status", strconv.Itoa(rec.Status))
+	write("bytes", strconv.FormatInt(rec.Written, 10))
+	write("duration_ms", strconv.FormatFloat(durationMs(rec.Duration), 'f', 3, 64))
+	write("remote_addr", rec.RemoteAddr)
+	if rec.User != "" {
+		write("user", rec.User)
+	}
+	if rec.UserAgent != "" {
+		write("user_agent", rec.UserAgent)
+	}
+	if rec.Referer != "" {
+		write("referer", rec.Referer)
+	}
+	if len(rec.Internal) != 0 {
+		write("internal", rec.InternalMessage())
+	}
+	if rec.Message != "" && rec.Status >= 400 {
+		write("message", rec.Message)
+	}
+	if rec.Panic != "" {
+		write("panic", rec.Panic)
+		write("stack", rec.Stack)
+	}
+
+	return sb.String()
+}
+
+func commonAccessLog(rec *AccessRecord) string {
+	host, _, err := net.SplitHostPort(rec.RemoteAddr)
+	if err != nil {
+		host = rec.RemoteAddr
+	}
+
+	bytes := "-"
+	if rec.Written != 0 {
+		bytes = strconv.FormatInt(rec.Written, 10)
+	}
+
+	return fmt.Sprintf(`%s - %s [%s] "%s %s %s" %d %s`,
+		clfField(host), clfField(rec.User),
+		rec.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		rec.Method, rec.URI, rec.Proto,
+		rec.Status, bytes,
+	)
+}
+
+func combinedAccessLog(rec *AccessRecord) string {
+	return fmt.Sprintf(`%s %s %s`,
+		commonAccessLog(rec),
+		strconv.Quote(clfField(rec.Referer)),
+		strconv.Quote(clfField(rec.UserAgent)),
+	)
+}
+
+func clfField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// Attrs returns the record as a list of slog attributes
+func (rec *AccessRecord) Attrs() []slog.Attr {
+	attrs := []slog.Attr{
+		slog.String("method", rec.Method),
+		slog.String("uri", rec.URI),
+		slog.String("host", rec.Host),
+		slog.String("proto", rec.Proto),
+		slog.Bool("secure", rec.Secure),
+		slog.Int("status", rec.Status),
+		slog.Int64("bytes", rec.Written),
+		slog.Duration("duration", rec.Duration),
+		slog.String("remote_addr", rec.RemoteAddr),
+	}
+
+	if rec.CustomHost != "" {
+		attrs = append(attrs, slog.String("custom_host", rec.CustomHost))
+	}
+	if rec.User != "" {
+		attrs = append(attrs, slog.String("user", rec.User))
+	}
+	if rec.UserAgent != "" {
+		attrs = append(attrs, slog.String("user_agent", rec.UserAgent))
+	}
+	if rec.Referer != "" {
+		attrs = append(attrs, slog.String("referer", rec.Referer))
+	}
+	if len(rec.Internal) != 0 {
+		attrs = append(attrs, slog.Any("internal", rec.Internal))
+	}
+	if rec.Message != "" && rec.Status >= 400 {
+		attrs = append(attrs, slog.String("message", rec.Message))
+	}
+	if rec.Panic != "" {
+		attrs = append(attrs, slog.String("panic", rec.Panic), slog.String("stack", rec.Stack))
+	}
+
+	return attrs
+}
+
+// LogValue implements slog.LogValuer
+func (rec *AccessRecord) LogValue() slog.Value {
+	return slog.GroupValue(rec.Attrs()...)
+}
+
+type slogAccessLogger struct {
+	l *slog.Logger
+}
+
+// SlogAccessLog returns an AccessLogger sending the records to the slog
+// Logger instead of the logger of the Context
+func SlogAccessLog(l *slog.Logger) AccessLogger {
+	if l == nil {
+		l = slog.Default()
+	}
+	return slogAccessLogger{ l: l }
+}
+
+func (sl slogAccessLogger) LogAccess(_ *logger.Logger, rec *AccessRecord) {
+	level := slog.LevelInfo
+	switch {
+	case rec.Panic != "" || rec.Status >= 500:
+		level = slog.LevelError
+	case rec.Status >= 400:
+		level = slog.LevelWarn
+	}
+
+	sl.l.LogAttrs(context.Background(), level, "http request", rec.Attrs()...)
+}
@@ -0,0 +1,411 @@
+package nix
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nixpare/logger/v3"
+)
+
+// CGI runs the scripts inside a directory with a CGI environment. It is
+// served with Context.ServeCGI.
+//
+// The request path, without the prefix, is mapped to the first executable
+// found walking the directory, and the remaining part is passed as
+// PATH_INFO. Only the environment variables whitelisted with
+// CGIInheritEnvOption (plus PATH and the ones needed by the dynamic
+// linker) are inherited from the server.
+//
+// The output of the script is buffered until it exits, so that a script
+// exiting with a non-zero code or killed after the timeout is reported
+// as an error instead of sending a partial response
+type CGI struct {
+	root       string
+	prefix     string
+	args       []string
+	env        []string
+	inheritEnv []string
+	timeout    time.Duration
+}
+
+type CGIOption func(cgi *CGI) error
+
+var cgiDefaultInheritEnv = func() []string {
+	switch runtime.GOOS {
+	case "darwin", "ios":
+		return []string{ "PATH", "DYLD_LIBRARY_PATH" }
+	case "windows":
+		return []string{ "PATH", "SystemRoot", "COMSPEC", "PATHEXT", "WINDIR" }
+	default:
+		return []string{ "PATH", "LD_LIBRARY_PATH" }
+	}
+}()
+
+// NewCGI creates a new CGI serving the scripts in the directory root
+func NewCGI(root string, opts ...CGIOption) (*CGI, error) {
+	abs, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+
+	cgi := &CGI{
+		root:    abs,
+		prefix:  "/",
+		timeout: 30 * time.Second,
+	}
+
+	for _, opt := range opts {
+		if err := opt(cgi); err != nil {
+			return nil, err
+		}
+	}
+
+	return cgi, nil
+}
+
+// CGIPrefixOption sets the URL path prefix mapped to the directory,
+// by default "/"
+func CGIPrefixOption(prefix string) CGIOption {
+	return func(cgi *CGI) error {
+		cgi.prefix = path.Clean("/" + prefix)
+		return nil
+	}
+}
+
+// CGIArgsOption sets the arguments passed to every script
+func CGIArgsOption(args ...string) CGIOption {
+	return func(cgi *CGI) error {
+		cgi.args = args
+		return nil
+	}
+}
+
+// CGIEnvOption sets an additional environment variable of the scripts
+func CGIEnvOption(key string, value string) CGIOption {
+	return func(cgi *CGI) error {
+		cgi.env = append(cgi.env, key + "=" + value)
+		return nil
+	}
+}
+
+// CGIInheritEnvOption adds the environment variables of the server
+// inherited by the scripts
+func CGIInheritEnvOption(keys ...string) CGIOption {
+	return func(cgi *CGI) error {
+		cgi.inheritEnv = append(cgi.inheritEnv, keys...)
+		return nil
+	}
+}
+
+// CGITimeoutOption sets the maximum run time of the scripts, after
+// which they are killed. Zero means no timeout
+func CGITimeoutOption(d time.Duration) CGIOption {
+	return func(cgi *CGI) error {
+		cgi.timeout = d
+		return nil
+	}
+}
+
+// script returns the script matching the request path and the path info,
+// or an empty script name if there is none
+func (cgi *CGI) script(urlPath string) (scriptName string, pathInfo string) {
+	p := path.Clean("/" + urlPath)
+	if p != cgi.prefix && !strings.HasPrefix(p, strings.TrimSuffix(cgi.prefix, "/") + "/") {
+		return
+	}
+
+	rel := strings.TrimPrefix(p, strings.TrimSuffix(cgi.prefix, "/"))
+	segments := strings.Split(strings.Trim(rel, "/"), "/")
+
+	for i := range segments {
+		if segments[i] == "" || segments[i][0] == '.' {
+			return
+		}
+
+		scriptPath := filepath.Join(cgi.root, filepath.FromSlash(strings.Join(segments[:i+1], "/")))
+		info, err := os.Stat(scriptPath)
+		if err != nil {
+			return
+		}
+
+		if info.Mode().IsRegular() {
+			if runtime.GOOS != "windows" && info.Mode().Perm() & 0o111 == 0 {
+				return
+			}
+
+			scriptName = path.Join(cgi.prefix, strings.Join(segments[:i+1], "/"))
+			if i + 1 < len(segments) {
+				pathInfo = "/" + strings.Join(segments[i+1:], "/")
+			}
+			return
+		}
+	}
+
+	return
+}
+
+func (cgi *CGI) environ(r *http.Request, scriptName string, pathInfo string) []string {
+	port := "80"
+	if r.TLS != nil {
+		port = "443"
+	}
+	serverName := r.Host
+	if host, p, err := net.SplitHostPort(r.Host); err == nil {
+		serverName, port = host, p
+	}
+
+	env := []string{
+		"SERVER_SOFTWARE=nix",
+		"SERVER_PROTOCOL=" + r.Proto,
+		"SERVER_NAME=" + serverName,
+		"SERVER_PORT=" + port,
+		"GATEWAY_INTERFACE=CGI/1.1",
+		"REQUEST_METHOD=" + r.Method,
+		"REQUEST_URI=" + r.URL.RequestURI(),
+		"QUERY_STRING=" + r.URL.RawQuery,
+		"SCRIPT_NAME=" + scriptName,
+		"SCRIPT_FILENAME=" + filepath.Join(cgi.root, filepath.FromSlash(strings.TrimPrefix(scriptName, cgi.prefix))),
+		"PATH_INFO=" + pathInfo,
+		"DOCUMENT_ROOT=" + cgi.root,
+		"HTTP_HOST=" + r.Host,
+	}
+
+	if ip, remotePort, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		env = append(env, "REMOTE_ADDR=" + ip, "REMOTE_HOST=" + ip, "REMOTE_PORT=" + remotePort)
+	} else {
+		env = append(env, "REMOTE_ADDR=" + r.RemoteAddr, "REMOTE_HOST=" + r.RemoteAddr)
+	}
+
+	if r.TLS != nil {
+		env = append(env, "HTTPS=on")
+	}
+
+	for k, v := range r.Header {
+		k = strings.ToUpper(strings.ReplaceAll(k, "-", "_"))
+		// httpoxy: the Proxy header must never become HTTP_PROXY
+		if k == "PROXY" {
+			continue
+		}
+
+		sep := ", "
+		if k == "COOKIE" {
+			sep = "; "
+		}
+		env = append(env, "HTTP_" + k + "=" + strings.Join(v, sep))
+	}
+
+	if r.ContentLength > 0 {
+		env = append(env, "CONTENT_LENGTH=" + strconv.FormatInt(r.ContentLength, 10))
+	}
+	if ctype := r.Header.Get("Content-Type"); ctype != "" {
+		env = append(env, "CONTENT_TYPE=" + ctype)
+	}
+
+	for _, key := range append(slices.Clone(cgiDefaultInheritEnv), cgi.inheritEnv...) {
+		if value, ok := os.LookupEnv(key); ok {
+			env = append(env, key + "=" + value)
+		}
+	}
+
+	// The later values take precedence, as with exec.Cmd.Env
+	return append(env, cgi.env...)
+}
+
+// ServeCGI runs the script matching the request and sends its response.
+// A request not matching any script is reported with a 404 error, a
+// script killed after the timeout with a 504 error and any other failure,
+// including a non-zero exit code, with a 500 error: in these last cases
+// the error is also returned. The standard error of the script is logged
+// with the Context logger
+func (ctx *Context) ServeCGI(cgi *CGI) error {
+	r := ctx.r
+
+	scriptName, pathInfo := cgi.script(r.URL.Path)
+	if scriptName == "" {
+		ctx.Error(http.StatusNotFound, "Not found")
+		return nil
+	}
+
+	if len(r.TransferEncoding) > 0 && r.TransferEncoding[0] == "chunked" {
+		ctx.Error(http.StatusBadRequest, "Chunked request bodies are not supported by CGI")
+		return nil
+	}
+
+	runCtx := r.Context()
+	if cgi.timeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(runCtx, cgi.timeout)
+		defer cancel()
+	}
+
+	// Shallow copy of the request to use the remote address of the Context
+	req := r.WithContext(r.Context())
+	req.RemoteAddr = ctx.RemoteAddr()
+
+	scriptPath := filepath.Join(cgi.root, filepath.FromSlash(strings.TrimPrefix(scriptName, cgi.prefix)))
+	stdout := new(bytes.Buffer)
+	stderr := &cgiLogWriter{ l: ctx.Logger(), script: scriptName }
+
+	cmd := exec.CommandContext(runCtx, scriptPath, cgi.args...)
+	cmd.Dir = filepath.Dir(scriptPath)
+	cmd.Env = cgi.environ(req, scriptName, pathInfo)
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	// Do not wait forever for the children of a killed script holding the pipes
+	cmd.WaitDelay = time.Second
+	if r.ContentLength != 0 {
+		cmd.Stdin = r.Body
+	}
+
+	err := cmd.Run()
+	stderr.Flush()
+
+	if err != nil {
+		if errors.Is(runCtx.Err(), context.DeadlineExceeded) {
+			err = fmt.Errorf("cgi script %s killed after %v: %w", scriptName, cgi.timeout, err)
+			ctx.Error(http.StatusGatewayTimeout, "Gateway timeout", err)
+			return err
+		}
+
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			err = fmt.Errorf("cgi script %s exited with code %d", scriptName, exitErr.ExitCode())
+		} else {
+			err = fmt.Errorf("cgi script %s error: %w", scriptName, err)
+		}
+
+		ctx.Error(http.StatusInternalServerError, "Internal server error", err)
+		return err
+	}
+
+	if err = ctx.writeCGIResponse(bufio.NewReader(stdout)); err != nil {
+		err = fmt.Errorf("cgi script %s: %w", scriptName, err)
+		ctx.Error(http.StatusInternalServerError, "Internal server error", err)
+		return err
+	}
+
+	return nil
+}
+
+// writeCGIResponse parses the headers of the script output as described
+// in RFC 3875 and sends the response
+func (ctx *Context) writeCGIResponse(output *bufio.Reader) error {
+	header := make(http.Header)
+	statusCode := 0
+	sawBlankLine := false
+
+	for {
+		line, err := output.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("error reading headers: %w", err)
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			sawBlankLine = err == nil
+			break
+		}
+
+		name, value, ok := strings.Cut(line, ":")
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			ctx.Logger().Printf(logger.LOG_LEVEL_WARNING, "CGI bogus header line: %q", line)
+		} else if value = strings.TrimSpace(value); name == "Status" {
+			if len(value) < 3 {
+				return fmt.Errorf("bogus status %q", value)
+			}
+
+			statusCode, err = strconv.Atoi(value[:3])
+			if err != nil {
+				return fmt.Errorf("bogus status %q", value)
+			}
+		} else {
+			header.Add(name, value)
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	if len(header) == 0 && statusCode == 0 || !sawBlankLine {
+		return errors.New("no headers")
+	}
+
+	if header.Get("Location") != "" && statusCode == 0 {
+		statusCode = http.StatusFound
+	}
+
+	if statusCode == 0 {
+		if header.Get("Content-Type") == "" {
+			return errors.New("missing required Content-Type in headers")
+		}
+		statusCode = http.StatusOK
+	}
+
+	for name, values := range header {
+		for _, value := range values {
+			ctx.Header().Add(name, value)
+		}
+	}
+
+	ctx.WriteHeader(statusCode)
+	_, err := output.WriteTo(ctx)
+	return err
+}
+
+// cgiLogWriter logs every line written by a script on its standard error
+type cgiLogWriter struct {
+	l      *logger.Logger
+	script string
+	mutex  sync.Mutex
+	buf    []byte
+}
+
+func (w *cgiLogWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+
+		w.log(w.buf[:i])
+		w.buf = w.buf[i+1:]
+	}
+
+	return len(p), nil
+}
+
+// Flush logs the last line if not terminated by a new line
+func (w *cgiLogWriter) Flush() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if len(w.buf) != 0 {
+		w.log(w.buf)
+		w.buf = nil
+	}
+}
+
+func (w *cgiLogWriter) log(line []byte) {
+	w.l.Printf(logger.LOG_LEVEL_WARNING, "CGI [%s] %s", w.script, bytes.TrimRight(line, "\r"))
+}
@@ -39,6 +39,8 @@ type Context struct {
 
 	l *logger.Logger
 
+	accessLog AccessLogger
+
 	remoteAddr string
 
 	customHostLog string
@@ -55,6 +57,8 @@ type Context struct {
 
 	errTemplate *template.Template
 
+	problemJSON bool
+
 	code int
 
 	written int64
@@ -64,6 +68,12 @@ type Context struct {
 	cookieManager *middleware.CookieManager
 
 	cache *middleware.Cache
+
+	collector *MetricsCollector
+
+	params []Param
+
+	route string
 }
 
 var contextPool = sync.Pool{
@@ -79,6 +89,7 @@ func newContext(w http.ResponseWriter, r *http.Request) *Context {
 	ctx.w = w
 	ctx.r = r
 	ctx.l = nil
+	ctx.accessLog = nil
 	ctx.remoteAddr = r.RemoteAddr
 	ctx.customHostLog = ""
 	ctx.connTime = time.Now()
@@ -87,11 +98,15 @@ func newContext(w http.ResponseWriter, r *http.Request) *Context {
 	ctx.enableRecovery = false
 	ctx.caputedError = CapturedError{}
 	ctx.errTemplate = nil
+	ctx.problemJSON = false
 	ctx.code = 0
 	ctx.written = 0
 	ctx.hijacked = false
 	ctx.cookieManager = nil
 	ctx.cache = nil
+	ctx.collector = nil
+	ctx.params = ctx.params[:0]
+	ctx.route = ""
 
 	return ctx
 }
@@ -152,6 +167,24 @@ func (ctx *Context) Main() *Context {
 	return GetMain(ctx.r)
 }
 
+// StatusCode returns the status code set for the response, or 0
+// if it was not set yet
+func (ctx *Context) StatusCode() int {
+	return ctx.code
+}
+
+// Written returns the number of bytes of the body sent to the client.
+// When the error capture is enabled and the status code is an error,
+// the body is sent only after the whole middleware chain returned
+func (ctx *Context) Written() int64 {
+	return ctx.written
+}
+
+// Duration returns the time elapsed since the request was received
+func (ctx *Context) Duration() time.Duration {
+	return time.Since(ctx.connTime)
+}
+
 func (ctx *Context) W() http.ResponseWriter {
 	return ctx.w
 }
@@ -160,7 +193,11 @@ func (ctx *Context) R() *http.Request {
 	return ctx.r
 }
 
-func serveContext(ctx *Context, handlerFunc func(*Context)) {
+func serveContext(ctx *Context, handlerFunc HandlerFunc) {
+	if ctx.collector != nil {
+		defer ctx.collector.end(ctx, ctx.collector.begin(ctx))
+	}
+
 	if ctx.enableRecovery {
 		panicErr := logger.CapturePanic(func() error {
 			handlerFunc(ctx)
@@ -190,7 +227,7 @@ func serveContext(ctx *Context, handlerFunc func(*Context)) {
 				}
 			}
 
-			ctx.logHTTPPanic(ctx.getMetrics())
+			ctx.logAccess(ctx.getMetrics(), fmt.Sprint(panicErr.Unwrap()), fmt.Sprintf("%s", panicErr.Stack()))
 			return
 		}
 	} else {
@@ -209,14 +246,5 @@ func serveContext(ctx *Context, handlerFunc func(*Context)) {
 		return
 	}
 
-	metrics := ctx.getMetrics()
-
-	switch {
-	case metrics.Code < 400:
-		ctx.logHTTPInfo(metrics)
-	case metrics.Code >= 400 && metrics.Code < 500:
-		ctx.logHTTPWarning(metrics)
-	default:
-		ctx.logHTTPError(metrics)
-	}
+	ctx.logAccess(ctx.getMetrics(), "", "")
 }
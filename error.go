@@ -3,9 +3,11 @@ package nix
 import (
 	"bytes"
 	"embed"
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
@@ -29,9 +31,27 @@ func DefaultErrTemplate() *template.Template {
 type CapturedError struct {
 	Code     int
 	Data     []byte
+	Problem  *ProblemDetails
 	internal []string
 }
 
+// ProblemDetails holds the members of an RFC 9457 problem details object
+// that are not derived from the captured error. It can be passed to
+// Context.Error along with the internal messages to be attached to the
+// response when the problem+json format is selected.
+//
+// Type defaults to "about:blank" and Title to the status text of the
+// response code, while the detail member is the error message. The
+// Extensions are added as top level members
+type ProblemDetails struct {
+	Type       string
+	Title      string
+	Instance   string
+	Extensions map[string]any
+}
+
+const problemJSONType = "application/problem+json"
+
 func (err CapturedError) Message() string {
 	return string(err.Data)
 }
@@ -61,7 +81,9 @@ func (ctx *Context) writeError(data []byte, ctype string) {
 // serveError serves the error in a predefines error template (if set) and only
 // if no other information was alredy sent to the ResponseWriter. If there is no
 // error template or if the connection method is different from GET or HEAD, the
-// error message is sent as a plain text
+// error message is sent as a plain text.
+// If the problem+json format is enabled, the format is instead negotiated with
+// the Accept header of the request (see serveNegotiatedError)
 func (ctx *Context) serveError() {
 	ctype := http.DetectContentType(ctx.caputedError.Data)
 	if len(ctx.caputedError.Data) != 0 {
@@ -71,6 +93,11 @@ func (ctx *Context) serveError() {
 		}
 	}
 
+	if ctx.problemJSON {
+		ctx.serveNegotiatedError()
+		return
+	}
+
 	if len(ctx.caputedError.Data) == 0 {
 		ctx.writeError(ctx.caputedError.Data, ctype)
 		return
@@ -103,6 +130,149 @@ func (ctx *Context) serveError() {
 	ctx.writeError(b.Bytes(), ctype)
 }
 
+// serveNegotiatedError serves the error choosing between the error template,
+// problem+json and plain text based on the Accept header, preferring problem+json
+// when the client accepts everything. The template is considered only for GET
+// and HEAD requests. If the handler has already set a JSON Content-Type, the
+// captured data is sent as is
+func (ctx *Context) serveNegotiatedError() {
+	if ctype := ctx.w.Header().Get("Content-Type"); strings.Contains(ctype, "json") {
+		ctx.writeError(ctx.caputedError.Data, ctype)
+		return
+	}
+
+	offers := [][]string{ { problemJSONType, "application/json" } }
+	if ctx.errTemplate != nil && (ctx.r.Method == "GET" || ctx.r.Method == "HEAD") {
+		offers = append(offers, []string{ "text/html" })
+	}
+	offers = append(offers, []string{ "text/plain" })
+
+	switch negotiate(ctx.r.Header.Get("Accept"), offers) {
+	case problemJSONType:
+		data, err := json.Marshal(ctx.caputedError.problemObject())
+		if err != nil {
+			ctx.AddInteralMessage("Error encoding problem details:", err)
+			break
+		}
+
+		ctx.writeError(data, problemJSONType)
+		return
+	case "text/html":
+		b := bytes.NewBuffer(nil)
+		if err := ctx.errTemplate.Execute(b, ctx.caputedError); err != nil {
+			ctx.AddInteralMessage("Error serving template file:", err)
+			break
+		}
+
+		ctx.writeError(b.Bytes(), "text/html; charset=utf-8")
+		return
+	}
+
+	ctx.writeError(ctx.caputedError.Data, "text/plain; charset=utf-8")
+}
+
+// problemObject returns the problem details object of the error
+func (err CapturedError) problemObject() map[string]any {
+	obj := make(map[string]any)
+
+	var p ProblemDetails
+	if err.Problem != nil {
+		p = *err.Problem
+	}
+
+	for key, value := range p.Extensions {
+		obj[key] = value
+	}
+
+	if p.Type == "" {
+		p.Type = "about:blank"
+	}
+	if p.Title == "" {
+		p.Title = http.StatusText(err.Code)
+	}
+
+	obj["type"] = p.Type
+	obj["title"] = p.Title
+	obj["status"] = err.Code
+	if detail := strings.TrimSpace(string(err.Data)); detail != "" {
+		obj["detail"] = detail
+	}
+	if p.Instance != "" {
+		obj["instance"] = p.Instance
+	}
+
+	return obj
+}
+
+// negotiate returns the first media type of the offer with the highest
+// quality in the Accept header. Each offer can be matched by any of its
+// media types, but the first is the one returned. An empty Accept header
+// accepts everything
+func negotiate(accept string, offers [][]string) string {
+	if len(offers) == 0 {
+		return ""
+	}
+
+	if strings.TrimSpace(accept) == "" {
+		return offers[0][0]
+	}
+
+	var best string
+	var bestQ float64
+	for _, offer := range offers {
+		for _, mime := range offer {
+			if q := acceptQuality(accept, mime); q > bestQ {
+				best, bestQ = offer[0], q
+			}
+		}
+	}
+
+	return best
+}
+
+// acceptQuality returns the quality assigned to the media type by the most
+// specific media range of the Accept header matching it, or 0 if none does
+func acceptQuality(accept string, mime string) float64 {
+	typ, sub, _ := strings.Cut(mime, "/")
+
+	q, specificity := 0., -1
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+
+		rangeTyp, rangeSub, _ := strings.Cut(strings.ToLower(strings.TrimSpace(params[0])), "/")
+
+		var s int
+		switch {
+		case rangeTyp == typ && rangeSub == sub:
+			s = 2
+		case rangeTyp == typ && rangeSub == "*":
+			s = 1
+		case rangeTyp == "*" && rangeSub == "*":
+			s = 0
+		default:
+			continue
+		}
+
+		if s < specificity {
+			continue
+		}
+
+		rangeQ := 1.
+		for _, param := range params[1:] {
+			key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(key, "q") {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					rangeQ = parsed
+				}
+			}
+		}
+
+		q, specificity = rangeQ, s
+	}
+
+	return q
+}
+
 // Error is used to manually report an HTTP Error to send to the
 // client.
 //
@@ -114,7 +284,9 @@ func (ctx *Context) serveError() {
 // message will be sent as a plain text.
 //
 // The last optional list of elements can be used just for logging or
-// debugging: the elements will be saved in the logs
+// debugging: the elements will be saved in the logs. The only exception
+// are ProblemDetails (or pointers to them), which are attached to the
+// response when it is rendered as problem+json
 func (ctx *Context) Error(statusCode int, message string, a ...any) {
 	ctx.WriteHeader(statusCode)
 
@@ -123,7 +295,22 @@ func (ctx *Context) Error(statusCode int, message string, a ...any) {
 	}
 
 	ctx.String(message)
-	ctx.AddInteralMessage(a...)
+
+	internal := a[:0:0]
+	for _, x := range a {
+		switch p := x.(type) {
+		case ProblemDetails:
+			ctx.caputedError.Problem = &p
+		case *ProblemDetails:
+			ctx.caputedError.Problem = p
+		default:
+			internal = append(internal, x)
+		}
+	}
+
+	if len(internal) != 0 || len(a) == 0 {
+		ctx.AddInteralMessage(internal...)
+	}
 }
 
 func (ctx *Context) AddInteralMessage(a ...any) {
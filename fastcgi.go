@@ -0,0 +1,243 @@
+package nix
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/nixpare/logger/v3"
+	"github.com/yookoala/gofast"
+)
+
+// FastCGI is a client of an external FastCGI responder (PHP-FPM, flup,
+// a PHPProcessor, ...) reachable over TCP or a unix socket. It is served
+// with Context.ServeFastCGI.
+//
+// The request path is split in SCRIPT_NAME and PATH_INFO at the first
+// segment ending with one of the split extensions (by default ".php"),
+// and SCRIPT_FILENAME is the script name inside the document root, as
+// seen by the responder. Requests for a directory are routed to the first
+// index file found in it. In front controller mode every request is routed
+// to the same script instead, with the whole path as PATH_INFO
+type FastCGI struct {
+	connFactory     gofast.ConnFactory
+	root            string
+	splitExts       []string
+	index           []string
+	frontController string
+	params          map[string]string
+}
+
+type FastCGIOption func(fcgi *FastCGI) error
+
+// NewFastCGI creates a new FastCGI client for the responder listening
+// on the address, where network is either "tcp" or "unix"
+func NewFastCGI(network string, address string, opts ...FastCGIOption) (*FastCGI, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6", "unix":
+	default:
+		return nil, fmt.Errorf("fastcgi: unsupported network %q", network)
+	}
+
+	return newFastCGI(gofast.SimpleConnFactory(network, address), opts...)
+}
+
+func newFastCGI(connFactory gofast.ConnFactory, opts ...FastCGIOption) (*FastCGI, error) {
+	fcgi := &FastCGI{
+		connFactory: connFactory,
+		splitExts:   []string{ ".php" },
+		index:       []string{ "index.php" },
+		params:      make(map[string]string),
+	}
+
+	for _, opt := range opts {
+		if err := opt(fcgi); err != nil {
+			return nil, err
+		}
+	}
+
+	return fcgi, nil
+}
+
+// FastCGIRootOption sets the document root used to build SCRIPT_FILENAME
+// and PATH_TRANSLATED. The path refers to the file system of the responder
+func FastCGIRootOption(root string) FastCGIOption {
+	return func(fcgi *FastCGI) error {
+		fcgi.root = filepath.Clean(root)
+		return nil
+	}
+}
+
+// FastCGISplitPathOption sets the extensions of the scripts used to split
+// the request path in SCRIPT_NAME and PATH_INFO. Without any extension
+// the whole path is used as the script name
+func FastCGISplitPathOption(exts ...string) FastCGIOption {
+	return func(fcgi *FastCGI) error {
+		fcgi.splitExts = exts
+		return nil
+	}
+}
+
+// FastCGIIndexOption sets the index files of the directories: the first one
+// existing in the document root is used, or the first one if none exists
+// (for example if the responder runs on another machine)
+func FastCGIIndexOption(files ...string) FastCGIOption {
+	return func(fcgi *FastCGI) error {
+		if len(files) == 0 {
+			return fmt.Errorf("fastcgi index option: no index files")
+		}
+
+		fcgi.index = files
+		return nil
+	}
+}
+
+// FastCGIFrontControllerOption routes every request to the script, relative
+// to the document root (for example "index.php")
+func FastCGIFrontControllerOption(script string) FastCGIOption {
+	return func(fcgi *FastCGI) error {
+		fcgi.frontController = path.Clean("/" + filepath.ToSlash(script))
+		return nil
+	}
+}
+
+// FastCGIParamOption sets an additional parameter passed to the responder,
+// overriding the one computed from the request if any
+func FastCGIParamOption(name string, value string) FastCGIOption {
+	return func(fcgi *FastCGI) error {
+		fcgi.params[name] = value
+		return nil
+	}
+}
+
+// splitPath returns the script name and the path info of the request path
+func (fcgi *FastCGI) splitPath(urlPath string) (scriptName string, pathInfo string) {
+	p := path.Clean("/" + urlPath)
+	if strings.HasSuffix(urlPath, "/") && p != "/" {
+		p += "/"
+	}
+
+	if fcgi.frontController != "" {
+		return fcgi.frontController, p
+	}
+
+	split := -1
+	for _, ext := range fcgi.splitExts {
+		for i := 0; i < len(p); {
+			j := strings.Index(p[i:], ext)
+			if j < 0 {
+				break
+			}
+
+			end := i + j + len(ext)
+			if end == len(p) || p[end] == '/' {
+				if split < 0 || end < split {
+					split = end
+				}
+				break
+			}
+			i = end
+		}
+	}
+
+	if split >= 0 {
+		return p[:split], p[split:]
+	}
+
+	if strings.HasSuffix(p, "/") {
+		return fcgi.indexFile(p), ""
+	}
+
+	return p, ""
+}
+
+func (fcgi *FastCGI) indexFile(dir string) string {
+	for _, index := range fcgi.index {
+		scriptName := path.Join(dir, index)
+		if _, err := os.Stat(filepath.Join(fcgi.root, filepath.FromSlash(scriptName))); err == nil {
+			return scriptName
+		}
+	}
+
+	return path.Join(dir, fcgi.index[0])
+}
+
+// mapParams is a gofast.Middleware setting the path related parameters
+// and the additional ones
+func (fcgi *FastCGI) mapParams(inner gofast.SessionHandler) gofast.SessionHandler {
+	return func(client gofast.Client, req *gofast.Request) (*gofast.ResponsePipe, error) {
+		r := req.Raw
+		scriptName, pathInfo := fcgi.splitPath(r.URL.Path)
+
+		req.Params["SERVER_SOFTWARE"] = "nix"
+		req.Params["REQUEST_URI"] = r.URL.RequestURI()
+		req.Params["DOCUMENT_URI"] = r.URL.Path
+		req.Params["DOCUMENT_ROOT"] = fcgi.root
+		req.Params["SCRIPT_NAME"] = scriptName
+		req.Params["SCRIPT_FILENAME"] = filepath.Join(fcgi.root, filepath.FromSlash(scriptName))
+		req.Params["PATH_INFO"] = pathInfo
+		if pathInfo != "" {
+			req.Params["PATH_TRANSLATED"] = filepath.Join(fcgi.root, filepath.FromSlash(pathInfo))
+		}
+
+		for name, value := range fcgi.params {
+			req.Params[name] = value
+		}
+
+		return inner(client, req)
+	}
+}
+
+// ServeFastCGI serves the request with the FastCGI responder. A failed
+// connection is reported with a 502 error and a failure before receiving
+// the response with a 500 error: in both cases the error is also returned.
+// The error stream of the responder is logged with the Context logger
+func (ctx *Context) ServeFastCGI(fcgi *FastCGI) error {
+	// Shallow copy of the request to use the remote address of the Context
+	r := ctx.r.WithContext(ctx.r.Context())
+	r.RemoteAddr = ctx.RemoteAddr()
+	if _, _, err := net.SplitHostPort(r.RemoteAddr); err != nil {
+		r.RemoteAddr = net.JoinHostPort(r.RemoteAddr, "0")
+	}
+
+	client, err := gofast.SimpleClientFactory(fcgi.connFactory)()
+	if err != nil {
+		err = fmt.Errorf("fastcgi connection error: %w", err)
+		ctx.Error(http.StatusBadGateway, "Bad gateway", err)
+		return err
+	}
+	defer client.Close()
+
+	session := gofast.Chain(
+		gofast.BasicParamsMap,
+		gofast.MapHeader,
+		fcgi.mapParams,
+	)(gofast.BasicSession)
+
+	resp, err := session(client, gofast.NewRequest(r))
+	if err != nil {
+		err = fmt.Errorf("fastcgi session error: %w", err)
+		ctx.Error(http.StatusInternalServerError, "Internal server error", err)
+		return err
+	}
+
+	stderr := new(bytes.Buffer)
+	err = resp.WriteTo(ctx, stderr)
+
+	if stderr.Len() > 0 {
+		ctx.Logger().Printf(logger.LOG_LEVEL_WARNING, "FastCGI [%s] %s", r.URL.Path, strings.TrimSpace(stderr.String()))
+	}
+
+	if err != nil {
+		err = fmt.Errorf("fastcgi response error: %w", err)
+		ctx.AddInteralMessage(err)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,138 @@
+package nix
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// fastCGITestResponder starts an in-process FastCGI responder echoing
+// the request and the parameters received, returning its address.
+// SCRIPT_NAME and PATH_INFO are not exposed by net/http/fcgi, so they are
+// checked through SCRIPT_FILENAME and PATH_TRANSLATED
+func fastCGITestResponder(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go fcgi.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		env := fcgi.ProcessEnv(r)
+
+		w.Header().Set("X-Responder", "fcgi")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, "method=%s\n", r.Method)
+		fmt.Fprintf(w, "uri=%s\n", r.URL.RequestURI())
+		fmt.Fprintf(w, "body=%s\n", body)
+		for _, name := range []string{ "SCRIPT_FILENAME", "PATH_TRANSLATED", "DOCUMENT_ROOT", "APP_ENV" } {
+			fmt.Fprintf(w, "%s=%s\n", name, env[name])
+		}
+	}))
+
+	return l.Addr().String()
+}
+
+func serveFastCGITest(fcgi *FastCGI, r *http.Request) (*httptest.ResponseRecorder, error) {
+	w := httptest.NewRecorder()
+	ctx := newContext(w, r)
+	return w, ctx.ServeFastCGI(fcgi)
+}
+
+func TestServeFastCGI(t *testing.T) {
+	addr := fastCGITestResponder(t)
+
+	tests := []struct {
+		name   string
+		opts   []FastCGIOption
+		method string
+		target string
+		body   string
+		want   []string
+	}{
+		{
+			name:   "split path",
+			opts:   []FastCGIOption{ FastCGIRootOption("/srv/www"), FastCGIParamOption("APP_ENV", "test") },
+			method: http.MethodGet,
+			target: "/app/index.php/users/42?page=2",
+			want: []string{
+				"method=GET", "uri=/app/index.php/users/42?page=2",
+				"SCRIPT_FILENAME=/srv/www/app/index.php", "PATH_TRANSLATED=/srv/www/users/42",
+				"DOCUMENT_ROOT=/srv/www", "APP_ENV=test",
+			},
+		},
+		{
+			name:   "front controller",
+			opts:   []FastCGIOption{ FastCGIRootOption("/srv/www"), FastCGIFrontControllerOption("index.php") },
+			method: http.MethodPost,
+			target: "/api/items",
+			body:   "name=nix",
+			want: []string{
+				"method=POST", "uri=/api/items", "body=name=nix",
+				"SCRIPT_FILENAME=/srv/www/index.php", "PATH_TRANSLATED=/srv/www/api/items",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fcgi, err := NewFastCGI("tcp", addr, tt.opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			r := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			if tt.body != "" {
+				r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			}
+
+			w, err := serveFastCGITest(fcgi, r)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if w.Code != http.StatusCreated {
+				t.Errorf("status %d, want %d", w.Code, http.StatusCreated)
+			}
+			if got := w.Header().Get("X-Responder"); got != "fcgi" {
+				t.Errorf("X-Responder header %q, want \"fcgi\"", got)
+			}
+
+			lines := strings.Split(w.Body.String(), "\n")
+			for _, want := range tt.want {
+				if !slices.Contains(lines, want) {
+					t.Errorf("missing %q in the response:\n%s", want, w.Body.String())
+				}
+			}
+		})
+	}
+}
+
+func TestServeFastCGIConnectionError(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	fcgi, err := NewFastCGI("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := serveFastCGITest(fcgi, httptest.NewRequest(http.MethodGet, "/index.php", nil))
+	if err == nil {
+		t.Fatal("no error with the responder not listening")
+	}
+	if w.Code != http.StatusBadGateway {
+		t.Errorf("status %d, want %d", w.Code, http.StatusBadGateway)
+	}
+}
@@ -4,15 +4,14 @@ go 1.23.2
 
 require (
 	github.com/gorilla/securecookie v1.1.2
+	github.com/gorilla/websocket v1.5.3
 	github.com/koding/websocketproxy v0.0.0-20181220232114-7ed82d81a28c
-	github.com/nixpare/broadcaster v1.3.0
 	github.com/nixpare/logger/v3 v3.0.4
 	github.com/nixpare/process v1.7.2
 	github.com/yookoala/gofast v0.8.0
 )
 
 require (
-	github.com/gorilla/websocket v1.5.3 // indirect
 	golang.org/x/sys v0.30.0 // indirect
 	golang.org/x/tools v0.30.0 // indirect
 )
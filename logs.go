@@ -1,13 +1,12 @@
 package nix
 
 import (
-	"fmt"
 	"html/template"
+	"slices"
 	"strings"
 	"time"
 
 	"github.com/nixpare/logger/v3"
-	"github.com/nixpare/nix/utility"
 )
 
 func (ctx *Context) Logger() *logger.Logger {
@@ -29,6 +28,14 @@ func (ctx *Context) SetLogger(l *logger.Logger) {
 	}
 }
 
+// SetAccessLogger sets the AccessLogger used to log the requests
+func (ctx *Context) SetAccessLogger(al AccessLogger) {
+	ctx.accessLog = al
+	if ctx.main != nil {
+		ctx.main.accessLog = al
+	}
+}
+
 func (ctx *Context) SetErrorTemplate(t *template.Template) {
 	ctx.errTemplate = t
 	if ctx.main != nil {
@@ -36,6 +43,15 @@ func (ctx *Context) SetErrorTemplate(t *template.Template) {
 	}
 }
 
+// SetProblemJSON enables or disables the problem+json format for the
+// captured errors, see ProblemJSONOption
+func (ctx *Context) SetProblemJSON(enable bool) {
+	ctx.problemJSON = enable
+	if ctx.main != nil {
+		ctx.main.problemJSON = enable
+	}
+}
+
 func (ctx *Context) SetCustomHostLog(host string) {
 	ctx.customHostLog = host
 	if ctx.main != nil {
@@ -87,110 +103,54 @@ const (
 	http_panic_format   = "%s%-21s%s - %s%d %-4s%s %-50s%s - %s%s (%6d ms)%s \u279C %s%s %s(%s)%s \u279C %spanic: %s%s"
 )
 
-func getProto(ctx *Context) string {
+func getProto(secure bool, proto string) string {
 	var lock string
-	if ctx.IsSecure() {
+	if secure {
 		lock = "🔒"
 	} else {
 		lock = "🔓"
 	}
 
-	return lock + " " + ctx.r.Proto
+	return lock + " " + proto
 }
 
-// logHTTPInfo logs http request with an exit code < 400
-func (ctx *Context) logHTTPInfo(m metrics) {
-	if len(ctx.caputedError.internal) == 0 {
-		ctx.Logger().Printf(logger.LOG_LEVEL_INFO, http_info_format,
-			logger.BRIGHT_BLUE_COLOR, m.RemoteAddr, logger.DEFAULT_COLOR,
-			logger.BRIGHT_GREEN_COLOR, m.Code,
-			ctx.r.Method, logger.DARK_GREEN_COLOR,
-			ctx.r.RequestURI, logger.DEFAULT_COLOR,
-			logger.BRIGHT_BLACK_COLOR, utility.PrintBytes(int(m.Written)),
-			m.Duration.Milliseconds(), logger.DEFAULT_COLOR,
-			logger.DARK_CYAN_COLOR, ctx.logHost(),
-			logger.BRIGHT_BLACK_COLOR, getProto(ctx), logger.DEFAULT_COLOR,
-		)
-	} else {
-		internal := ctx.caputedError.Internal()
-
-		ctx.Logger().Printf(logger.LOG_LEVEL_INFO, http_warning_format,
-			logger.BRIGHT_BLUE_COLOR, m.RemoteAddr, logger.DEFAULT_COLOR,
-			logger.BRIGHT_GREEN_COLOR, m.Code,
-			ctx.r.Method, logger.DARK_GREEN_COLOR,
-			ctx.r.RequestURI, logger.DEFAULT_COLOR,
-			logger.BRIGHT_BLACK_COLOR, utility.PrintBytes(int(m.Written)),
-			m.Duration.Milliseconds(), logger.DEFAULT_COLOR,
-			logger.DARK_CYAN_COLOR, ctx.logHost(),
-			logger.BRIGHT_BLACK_COLOR, getProto(ctx), logger.DEFAULT_COLOR,
-			logger.BRIGHT_GREEN_COLOR, internal, logger.DEFAULT_COLOR,
-		)
-	}
-}
+// logAccess logs the request with the access logger of the Context. If
+// the handler panicked, panicValue and stack must be provided
+func (ctx *Context) logAccess(m metrics, panicValue string, stack string) {
+	rec := ctx.newAccessRecord(m)
+	rec.Panic = panicValue
+	rec.Stack = stack
 
-// logHTTPWarning logs http request with an exit code >= 400 and < 500
-func (ctx *Context) logHTTPWarning(m metrics) {
-	internal := ctx.caputedError.Internal()
-	if internal == "" {
-		internal = strings.TrimSpace(string(ctx.caputedError.Data))
+	al := ctx.accessLog
+	if al == nil && ctx.main != nil {
+		al = ctx.main.accessLog
 	}
-
-	ctx.Logger().Printf(logger.LOG_LEVEL_WARNING, http_warning_format,
-		logger.BRIGHT_BLUE_COLOR, m.RemoteAddr, logger.DEFAULT_COLOR,
-		logger.DARK_YELLOW_COLOR, m.Code,
-		ctx.r.Method, logger.DARK_GREEN_COLOR,
-		ctx.r.RequestURI, logger.DEFAULT_COLOR,
-		logger.BRIGHT_BLACK_COLOR, utility.PrintBytes(int(m.Written)),
-		m.Duration.Milliseconds(), logger.DEFAULT_COLOR,
-		logger.DARK_CYAN_COLOR, ctx.logHost(),
-		logger.BRIGHT_BLACK_COLOR, getProto(ctx), logger.DEFAULT_COLOR,
-		logger.DARK_YELLOW_COLOR, internal, logger.DEFAULT_COLOR,
-	)
-}
-
-// logHTTPError logs http request with an exit code >= 500
-func (ctx *Context) logHTTPError(m metrics) {
-	internal := ctx.caputedError.Internal()
-	if internal == "" {
-		internal = strings.TrimSpace(string(ctx.caputedError.Data))
+	if al == nil {
+		al = PrettyAccessLog
 	}
 
-	ctx.Logger().Printf(logger.LOG_LEVEL_ERROR, http_error_format,
-		logger.BRIGHT_BLUE_COLOR, m.RemoteAddr, logger.DEFAULT_COLOR,
-		logger.DARK_RED_COLOR, m.Code,
-		ctx.r.Method, logger.DARK_GREEN_COLOR,
-		ctx.r.RequestURI, logger.DEFAULT_COLOR,
-		logger.BRIGHT_BLACK_COLOR, utility.PrintBytes(int(m.Written)),
-		m.Duration.Milliseconds(), logger.DEFAULT_COLOR,
-		logger.DARK_CYAN_COLOR, ctx.logHost(),
-		logger.BRIGHT_BLACK_COLOR, getProto(ctx), logger.DEFAULT_COLOR,
-		logger.DARK_RED_COLOR, internal, logger.DEFAULT_COLOR,
-	)
+	al.LogAccess(ctx.Logger(), rec)
 }
 
-func (ctx *Context) logHTTPPanic(m metrics) {
-	internal := ctx.caputedError.Internal()
-	if internal == "" {
-		internal = strings.TrimSpace(string(ctx.caputedError.Data))
+func (ctx *Context) newAccessRecord(m metrics) *AccessRecord {
+	user, _, _ := ctx.r.BasicAuth()
+
+	return &AccessRecord{
+		Time:       ctx.connTime,
+		Method:     ctx.r.Method,
+		URI:        ctx.r.RequestURI,
+		Host:       ctx.r.Host,
+		CustomHost: ctx.customHostLog,
+		Proto:      ctx.r.Proto,
+		Secure:     ctx.IsSecure(),
+		Status:     m.Code,
+		Written:    m.Written,
+		Duration:   m.Duration,
+		RemoteAddr: m.RemoteAddr,
+		User:       user,
+		UserAgent:  ctx.r.UserAgent(),
+		Referer:    ctx.r.Referer(),
+		Internal:   slices.Clone(ctx.caputedError.internal),
+		Message:    strings.TrimSpace(string(ctx.caputedError.Data)),
 	}
-
-	ctx.Logger().Printf(logger.LOG_LEVEL_FATAL, http_panic_format,
-		logger.BRIGHT_BLUE_COLOR, m.RemoteAddr, logger.DEFAULT_COLOR,
-		logger.DARK_RED_COLOR, m.Code,
-		ctx.r.Method, logger.DARK_GREEN_COLOR,
-		ctx.r.RequestURI, logger.DEFAULT_COLOR,
-		logger.BRIGHT_BLACK_COLOR, utility.PrintBytes(int(m.Written)),
-		m.Duration.Milliseconds(), logger.DEFAULT_COLOR,
-		logger.DARK_CYAN_COLOR, ctx.logHost(),
-		logger.BRIGHT_BLACK_COLOR, getProto(ctx), logger.DEFAULT_COLOR,
-		logger.DARK_RED_COLOR, internal, logger.DEFAULT_COLOR,
-	)
-}
-
-func (ctx *Context) logHost() string {
-	if ctx.customHostLog == "" {
-		return ctx.r.Host
-	}
-
-	return fmt.Sprintf("%s (%s)", ctx.r.Host, ctx.customHostLog)
 }
@@ -10,6 +10,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/nixpare/nix/utility"
@@ -35,36 +36,77 @@ type ContentInfo struct {
 
 type Cache struct {
 	dir      string
+	fsys     fs.FS
 	storage  map[string]*cacheStorage
-    ttl      time.Duration
+    ttl      atomic.Int64
     exts     []string
 	mutex    *sync.RWMutex
 	logger   *log.Logger
+	memory   *cacheMemory
+	compression *cacheCompression
+	ranges   *cacheRanges
+	preload  *preloadConfig
+	backend  Backend
+	stats    *cacheStats
+	responses map[string]*responseGroup
+	responsesSweep time.Time
+	watch    *cacheWatch
     disabled bool
 	notFoundHandler http.HandlerFunc
+	cacheControl    []cacheControlRule
 }
 
 func NewCache(logger *log.Logger, dir string, ttl time.Duration, extensions []string, opts ...Option) (*Cache, error) {
-	if logger == nil {
-		logger = log.Default()
-	}
-	
 	abs, err := filepath.Abs(dir)
 	if err == nil {
 		dir = abs
 	}
 
+	return newCache(logger, dir, nil, ttl, extensions, opts...)
+}
+
+// NewCacheFS creates a Cache serving the files inside fsys, for example
+// an embed.FS, instead of a directory on disk. The files with extensions
+// not cached are served directly from fsys too. The fs.FS is considered
+// to be read-only, so the cache cannot be watched for changes
+func NewCacheFS(logger *log.Logger, fsys fs.FS, ttl time.Duration, extensions []string, opts ...Option) (*Cache, error) {
+	if fsys == nil {
+		return nil, errors.New("cache: nil file system")
+	}
+
+	return newCache(logger, "", fsys, ttl, extensions, opts...)
+}
+
+func newCache(logger *log.Logger, dir string, fsys fs.FS, ttl time.Duration, extensions []string, opts ...Option) (*Cache, error) {
+	if logger == nil {
+		logger = log.Default()
+	}
+
 	c := &Cache{
 		dir:     dir,
+		fsys:    fsys,
 		storage: make(map[string]*cacheStorage),
-        ttl:     ttl,
+		responses: make(map[string]*responseGroup),
         exts:    extensions,
 		mutex:   new(sync.RWMutex),
 		logger:  logger,
+		memory:  &cacheMemory{ loaded: make(map[memoryEntry]int) },
+		compression: newCacheCompression(),
+		stats:   newCacheStats(),
 	}
+	c.ttl.Store(int64(ttl))
 
 	for _, opt := range opts {
-		err = opt(c)
+		err := opt(c)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// The preload is done after every option has been applied, so that
+	// the contents are loaded with the final configuration
+	if c.preload != nil {
+		err := c.Preload(c.preload.workers, c.preload.include, c.preload.exclude)
 		if err != nil {
 			return nil, err
 		}
@@ -74,7 +116,11 @@ func NewCache(logger *log.Logger, dir string, ttl time.Duration, extensions []st
 }
 
 func (c *Cache) SetFileCacheTTL(ttl time.Duration) {
-	c.ttl = ttl
+	c.ttl.Store(int64(ttl))
+}
+
+func (c *Cache) FileCacheTTL() time.Duration {
+	return time.Duration(c.ttl.Load())
 }
 
 func (c *Cache) EnableFileCache() {
@@ -97,11 +143,18 @@ func (c *Cache) DisableFileCache() {
     c.disabled = true
 
 	for _, s := range c.storage {
-		s.data = nil
+		s.version.Store(nil)
 	}
+	clear(c.responses)
+	c.memory.reset()
 }
 
 func (c *Cache) UpdateCache() error {
+	// The responses are removed and stored again when requested
+	c.mutex.Lock()
+	c.purgeResponses(func(path string) bool { return true })
+	c.mutex.Unlock()
+
 	c.mutex.RLock()
     defer c.mutex.RUnlock()
 
@@ -113,15 +166,24 @@ func (c *Cache) UpdateCache() error {
 	for path, s := range c.storage {
 		err := s.update()
 		if err != nil {
-			s.data = nil
+			s.version.Store(nil)
+			c.memory.release(s)
 			errs = append(errs, fmt.Errorf("update content \"%s\": %w", path, err))
 		}
 	}
 
-	return fmt.Errorf("cache update error: %w", errors.Join(errs...))
+	if len(errs) != 0 {
+		return fmt.Errorf("cache update error: %w", errors.Join(errs...))
+	}
+	return nil
 }
 
 func (c *Cache) UpdateContent(uri string) error {
+	// The responses are removed and stored again when requested
+	c.mutex.Lock()
+	purged := c.purgeResponses(func(path string) bool { return path == uri })
+	c.mutex.Unlock()
+
 	c.mutex.RLock()
     defer c.mutex.RUnlock()
 
@@ -131,6 +193,9 @@ func (c *Cache) UpdateContent(uri string) error {
 
 	s := c.storage[uri]
 	if s == nil {
+		if purged != 0 {
+			return nil
+		}
 		return fmt.Errorf("content update error: \"%s\" not found", uri)
 	}
 
@@ -161,21 +226,47 @@ func (c *Cache) DumpStatus() string {
 	sb.WriteString(" - Size: ")
 	var data []int
 	for _, cs := range c.storage {
-		data = append(data, len(cs.data))
+		if v := cs.version.Load(); v != nil {
+			data = append(data, v.length())
+		}
 	}
 	sb.WriteString(utility.PrintBytes(data...))
 
+	sb.WriteString(" - ")
+	sb.WriteString(c.memory.dumpStatus())
+
 	for uri, cs := range c.storage {
 		sb.WriteString("\n   - \"")
 		sb.WriteString(uri)
 		sb.WriteString("\" -> Size: ")
-		sb.WriteString(utility.PrintBytes(len(cs.data)))
-		sb.WriteString(" - Last Modify: ")
-		sb.WriteString(cs.info.Modtime.Format(time.DateTime))
+
+		v := cs.version.Load()
+		if v == nil {
+			sb.WriteString(utility.PrintBytes(0))
+			sb.WriteString(" (evicted)")
+		} else {
+			sb.WriteString(utility.PrintBytes(v.length()))
+			if v.chunks != nil {
+				n, size := v.chunks.bytes()
+				sb.WriteString(fmt.Sprintf(" (%d chunks, %s)", n, utility.PrintBytes(size)))
+			} else if v.buf == nil {
+				sb.WriteString(" (streamed)")
+			}
+		}
+
+		sb.WriteString(" - ")
+		writeStats(&sb, cs.stats.entryStats())
+		if v != nil {
+			sb.WriteString(" - Last Modify: ")
+			sb.WriteString(v.info.Modtime.Format(time.DateTime))
+		}
 		sb.WriteString(" - Expiration: ")
-		sb.WriteString(cs.expiration.Format(time.DateTime))
+		sb.WriteString(time.Unix(0, cs.expiration.Load()).Format(time.DateTime))
 	}
 
+	c.dumpStats(&sb)
+	c.dumpResponses(&sb)
+
 	return sb.String()
 }
 
@@ -186,24 +277,38 @@ func (c *Cache) ServeStatic(w http.ResponseWriter, r *http.Request) {
 func (c *Cache) ServeContent(w http.ResponseWriter, r *http.Request, uri string) {
 	c.mutex.RLock()
 	cs := c.storage[uri]
+	disabled := c.disabled
 	c.mutex.RUnlock()
 
+	// The request is a hit only if it is served from the version
+	// already in memory
+	hit := cs != nil
+	sw := &statsWriter{ ResponseWriter: w }
+
 	if cs == nil {
 		var ( staticPath string; skipped bool; err error )
 		cs, staticPath, skipped, err = c.getStaticFile(uri)
 		
 		if skipped {
-			http.ServeFile(w, r, filepath.Join(c.dir, staticPath))
+			c.setCacheControl(w, uri, staticPath)
+			if c.fsys != nil {
+				http.ServeFileFS(sw, r, c.fsys, strings.TrimPrefix(staticPath, "/"))
+			} else {
+				http.ServeFile(sw, r, filepath.Join(c.dir, staticPath))
+			}
+			c.stats.skipped(filepath.Ext(staticPath), sw.written)
 			return
 		}
 
 		if err != nil {
+			c.stats.total.errors.Add(1)
 			http.Error(w, "500 error retreiving content", http.StatusInternalServerError)
 			c.logger.Printf("error creating cached content at \"%s\": %v\n", uri, err)
 			return
 		}
 
 		if cs == nil {
+			c.stats.notFound.Add(1)
 			if c.notFoundHandler != nil {
 				c.notFoundHandler(w, r)
 			} else {
@@ -213,27 +318,62 @@ func (c *Cache) ServeContent(w http.ResponseWriter, r *http.Request, uri string)
 		}
 	}
 
-	if c.disabled {
-		c.serveContentNoCache(w, r, cs.content)
+	if disabled {
+		c.serveContentNoCache(sw, r, cs.content)
+		c.stats.served(cs, false, 0, sw.written)
 		return
 	}
-	
-	expiration := cs.expiration
 
-	if cs.data == nil || expiration.Before(time.Now()) {
+	v := cs.version.Load()
+	if v == nil || cs.expired() {
 		err := cs.update()
 		if err != nil {
 			c.logger.Printf("error updating content at \"%s\": %v\n", uri, err)
 			http.Error(w, "404 not found", http.StatusNotFound)
 			return
 		}
+
+		// The version could have been evicted again in the meantime
+		loaded := cs.version.Load()
+		hit = hit && loaded == v
+		v = loaded
+
+		if v == nil {
+			c.serveContentNoCache(sw, r, cs.content)
+			c.stats.served(cs, false, 0, sw.written)
+			return
+		}
 	}
 
-	http.ServeContent(
-        w, r,
-        cs.content.Name(), cs.info.Modtime,
-        cs.reader(),
-    )
+	cs.touch()
+	c.setCacheControl(w, uri, cs.content.Name())
+
+	// The content is too big to be kept in memory or it is cached in chunks
+	reader := v.reader()
+	if reader == nil {
+		if c.servePrecompressed(sw, r, cs, v) {
+			c.stats.served(cs, false, 0, sw.written)
+		} else if source, ok := c.serveChunks(sw, r, cs, v); ok {
+			// The chunks read from the source are bigger than the bytes sent
+			source = min(source, sw.written)
+			c.stats.served(cs, hit && source == 0, sw.written - source, source)
+		} else {
+			c.serveContentNoCache(sw, r, cs.content)
+			c.stats.served(cs, false, 0, sw.written)
+		}
+		return
+	}
+
+	if !c.serveVariant(sw, r, cs, v) {
+		v.setETag(w, "")
+
+		http.ServeContent(
+			sw, r,
+			cs.content.Name(), v.info.Modtime,
+			reader,
+		)
+	}
+	c.stats.served(cs, hit, sw.written, 0)
 }
 
 func (c *Cache) Handler() http.Handler {
@@ -252,7 +392,9 @@ func (c *Cache) serveContentNoCache(w http.ResponseWriter, r *http.Request, cont
 		http.Error(w, "404 not found", http.StatusNotFound)
 		return
 	}
+	defer reader.Close()
 
+	c.setCacheControl(w, content.URI(), content.Name())
     http.ServeContent(w, r, content.Name(), info.Modtime, reader)
 }
 
@@ -288,11 +430,17 @@ func (c *Cache) getStaticFile(path string) (*cacheStorage, string, bool, error)
 func (c *Cache) getStaticFileParsed(uri string, path string) (*cacheStorage, string, bool, error) {
 	ext := filepath.Ext(path)
 
-	if !slices.Contains(c.exts, ext) {
+	if !slices.Contains(c.exts, ext) && !c.ranges.matchExt(ext) {
 		return nil, path, true, nil
 	}
 
-	content := NewCachedFile(uri, c.dir, path)
+	var content Content
+	if c.fsys != nil {
+		content = NewFSFile(uri, c.fsys, path)
+	} else {
+		content = NewCachedFile(uri, c.dir, path)
+	}
+
 	cs, err := c.newContent(content)
 	if err != nil {
 		if !errors.Is(err, fs.ErrNotExist) {
@@ -0,0 +1,300 @@
+package middleware
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// CacheStatus is the status of a Cache, see Cache.Status
+type CacheStatus struct {
+	Enabled   bool                  `json:"enabled"`
+	Stats     CacheStats            `json:"stats"`
+	Memory    CacheMemoryStatus     `json:"memory"`
+	Contents  []CacheContentStatus  `json:"contents"`
+	Responses []CacheResponseStatus `json:"responses"`
+}
+
+type CacheMemoryStatus struct {
+	Used         int    `json:"used"`
+	Budget       int    `json:"budget,omitempty"`
+	Policy       string `json:"policy,omitempty"`
+	MaxEntrySize int    `json:"max_entry_size,omitempty"`
+	Evictions    uint64 `json:"evictions"`
+	EvictedBytes uint64 `json:"evicted_bytes"`
+}
+
+// CacheContentStatus is the status of a cached content. The state is one
+// of "loading", "loaded", "chunked", "streamed" and "evicted"
+type CacheContentStatus struct {
+	URI        string          `json:"uri"`
+	State      string          `json:"state"`
+	Size       int             `json:"size"`
+	Loaded     int             `json:"loaded"`
+	Chunks     int             `json:"chunks,omitempty"`
+	Modtime    time.Time       `json:"modtime"`
+	Expiration time.Time       `json:"expiration"`
+	LastAccess time.Time       `json:"last_access"`
+	Stats      CacheEntryStats `json:"stats"`
+}
+
+// CacheResponseStatus is the status of a response stored by a ResponseCache
+type CacheResponseStatus struct {
+	Key        string    `json:"key"`
+	Vary       []string  `json:"vary,omitempty"`
+	Status     int       `json:"status"`
+	Size       int       `json:"size"`
+	Stored     time.Time `json:"stored"`
+	Expiration time.Time `json:"expiration"`
+	Hits       uint64    `json:"hits"`
+}
+
+// Enabled reports whether the cache is enabled
+func (c *Cache) Enabled() bool {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	return !c.disabled
+}
+
+// Status returns the status of the cache, with the contents and the
+// responses sorted by URI
+func (c *Cache) Status() CacheStatus {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	status := CacheStatus{
+		Enabled:   !c.disabled,
+		Stats:     c.Stats(),
+		Memory:    c.memory.status(),
+		Contents:  make([]CacheContentStatus, 0, len(c.storage)),
+		Responses: make([]CacheResponseStatus, 0, len(c.responses)),
+	}
+
+	for uri, cs := range c.storage {
+		content := CacheContentStatus{
+			URI:        uri,
+			State:      "evicted",
+			Expiration: time.Unix(0, cs.expiration.Load()),
+			Stats:      cs.stats.entryStats(),
+		}
+		if lastAccess := cs.lastAccess.Load(); lastAccess != 0 {
+			content.LastAccess = time.Unix(0, lastAccess)
+		}
+
+		if v := cs.version.Load(); v != nil {
+			content.Size = v.info.Size
+			content.Modtime = v.info.Modtime
+			content.Loaded = v.length()
+
+			switch {
+			case v.chunks != nil:
+				content.State = "chunked"
+				content.Chunks, content.Loaded = v.chunks.bytes()
+			case v.buf == nil:
+				content.State = "streamed"
+			case v.buf.complete():
+				content.State = "loaded"
+			default:
+				content.State = "loading"
+			}
+		}
+
+		status.Contents = append(status.Contents, content)
+	}
+
+	for key, group := range c.responses {
+		for vk, resp := range group.responses {
+			var vary []string
+			if vk != "" {
+				vary = strings.Split(strings.TrimSuffix(vk, "\n"), "\n")
+			}
+
+			status.Responses = append(status.Responses, CacheResponseStatus{
+				Key:        key,
+				Vary:       vary,
+				Status:     resp.status,
+				Size:       len(resp.body),
+				Stored:     resp.stored,
+				Expiration: time.Unix(0, resp.expires.Load()),
+				Hits:       resp.hits.Load(),
+			})
+		}
+	}
+
+	slices.SortFunc(status.Contents, func(a, b CacheContentStatus) int {
+		return strings.Compare(a.URI, b.URI)
+	})
+	slices.SortFunc(status.Responses, func(a, b CacheResponseStatus) int {
+		return strings.Compare(a.Key, b.Key)
+	})
+
+	return status
+}
+
+func (m *cacheMemory) status() CacheMemoryStatus {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	status := CacheMemoryStatus{
+		Used:         m.used,
+		Budget:       m.budget,
+		MaxEntrySize: m.maxEntrySize,
+		Evictions:    m.evictions,
+		EvictedBytes: m.evictedBytes,
+	}
+	if m.budget > 0 {
+		status.Policy = m.policy.String()
+	}
+
+	return status
+}
+
+// Purge removes the content with the uri and the responses stored for it
+// from the cache and its backend, returning the number of entries removed.
+// The content is loaded again from its source when requested
+func (c *Cache) Purge(uri string) int {
+	return c.purge(func(path string) bool {
+		return path == uri
+	})
+}
+
+// PurgePrefix removes the contents and the responses whose URI starts
+// with prefix, see Purge
+func (c *Cache) PurgePrefix(prefix string) int {
+	return c.purge(func(path string) bool {
+		return strings.HasPrefix(path, prefix)
+	})
+}
+
+func (c *Cache) purge(match func(path string) bool) int {
+	var purged []*cacheStorage
+
+	c.mutex.Lock()
+	for uri, cs := range c.storage {
+		if !match(uri) {
+			continue
+		}
+
+		delete(c.storage, uri)
+		cs.version.Store(nil)
+		c.memory.release(cs)
+		purged = append(purged, cs)
+	}
+
+	n := c.purgeResponses(match)
+	c.mutex.Unlock()
+
+	// The backend could be remote, so it is updated without
+	// holding the lock
+	if c.backend != nil {
+		for _, cs := range purged {
+			cs.deleteBackend()
+		}
+	}
+
+	return n + len(purged)
+}
+
+// AdminHandler returns an http.Handler to manage the cache. GET requests
+// are answered with the status of the cache as JSON (see Cache.Status),
+// while POST requests run the action in the "action" form value:
+//   - "purge" removes the content in the "uri" form value, or the ones
+//     starting with the "prefix" form value (see Cache.Purge)
+//   - "reload" reloads every content (see Cache.UpdateCache)
+//   - "enable", "disable" and "toggle" enable or disable the cache
+//
+// Every request must be accepted by authorize (see BearerTokenAuth), so a
+// nil authorize rejects every request
+func (c *Cache) AdminHandler(authorize func(r *http.Request) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if authorize == nil || !authorize(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="cache"`)
+			writeAdminJSON(w, http.StatusUnauthorized, map[string]any{ "error": "unauthorized" })
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			writeAdminJSON(w, http.StatusOK, c.Status())
+		case http.MethodPost:
+			r.Body = http.MaxBytesReader(w, r.Body, 1 << 20)
+			c.serveAdminAction(w, r)
+		default:
+			w.Header().Set("Allow", "GET, HEAD, POST")
+			writeAdminJSON(w, http.StatusMethodNotAllowed, map[string]any{ "error": "method not allowed" })
+		}
+	})
+}
+
+func (c *Cache) serveAdminAction(w http.ResponseWriter, r *http.Request) {
+	action := r.FormValue("action")
+	result := map[string]any{ "action": action }
+
+	switch action {
+	case "purge":
+		uri, prefix := r.FormValue("uri"), r.FormValue("prefix")
+		switch {
+		case uri != "":
+			result["purged"] = c.Purge(uri)
+		case prefix != "":
+			result["purged"] = c.PurgePrefix(prefix)
+		default:
+			writeAdminJSON(w, http.StatusBadRequest, map[string]any{ "error": "purge: missing uri or prefix" })
+			return
+		}
+	case "reload":
+		if err := c.UpdateCache(); err != nil {
+			code := http.StatusInternalServerError
+			if errors.Is(err, ErrCacheDisabled) {
+				code = http.StatusConflict
+			}
+
+			writeAdminJSON(w, code, map[string]any{ "action": action, "error": err.Error() })
+			return
+		}
+	case "enable":
+		c.EnableFileCache()
+	case "disable":
+		c.DisableFileCache()
+	case "toggle":
+		if c.Enabled() {
+			c.DisableFileCache()
+		} else {
+			c.EnableFileCache()
+		}
+	default:
+		writeAdminJSON(w, http.StatusBadRequest, map[string]any{ "error": "unknown action \"" + action + "\"" })
+		return
+	}
+
+	result["enabled"] = c.Enabled()
+	c.logger.Printf("cache admin: %s from %s\n", action, r.RemoteAddr)
+	writeAdminJSON(w, http.StatusOK, result)
+}
+
+func writeAdminJSON(w http.ResponseWriter, code int, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	w.Write(data)
+}
+
+// BearerTokenAuth returns an authorize function for Cache.AdminHandler
+// accepting the requests with the token in the Authorization header
+func BearerTokenAuth(token string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		return ok && token != "" && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+	}
+}
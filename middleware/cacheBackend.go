@@ -0,0 +1,338 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// ErrBackendMiss is returned by a Backend not having the requested entry
+var ErrBackendMiss = errors.New("backend miss")
+
+// Backend is a second level storage of the cached contents, beside the
+// process memory. The contents loaded from their source are stored in the
+// backend, and the ones not in memory (never loaded since the start of the
+// process or evicted) are read from the backend instead of their source,
+// if the backend entry has the same modification time and size of the
+// content. The contents without a modification time (for example the
+// ones of an embed.FS) are never stored, as a changed content with the
+// same size could not be told apart. The keys are the URIs of the contents
+type Backend interface {
+	// Load returns the entry of the key, or ErrBackendMiss
+	Load(key string) (BackendEntry, error)
+	Store(key string, entry BackendEntry) error
+	Delete(key string) error
+}
+
+// BackendEntry is a content stored in a Backend
+type BackendEntry struct {
+	Modtime time.Time
+	Data    []byte
+}
+
+// BackendOption sets the second level storage of the cached contents, by
+// default the contents are kept only in the process memory. The contents
+// cached in chunks or too big to be kept in memory are not stored
+func BackendOption(backend Backend) Option {
+	return func(c *Cache) error {
+		c.backend = backend
+		return nil
+	}
+}
+
+// usesBackend reports whether the content version can be stored in the
+// backend: without a modification time a stale entry with the same size
+// would be taken as valid
+func (s *cacheStorage) usesBackend(info ContentInfo) bool {
+	return s.cache.backend != nil && !info.Modtime.IsZero()
+}
+
+// loadBackend returns the data stored in the backend for the content
+// version, if up to date
+func (s *cacheStorage) loadBackend(info ContentInfo) []byte {
+	entry, err := s.cache.backend.Load(s.content.URI())
+	if err != nil {
+		if !errors.Is(err, ErrBackendMiss) {
+			s.cache.logger.Printf("cache backend: error loading \"%s\": %v\n", s.content.URI(), err)
+		}
+		return nil
+	}
+
+	if len(entry.Data) != info.Size || !entry.Modtime.Equal(info.Modtime) {
+		return nil
+	}
+	return entry.Data
+}
+
+// storeBackend stores the loaded version in the backend
+func (s *cacheStorage) storeBackend(v *cacheVersion) {
+	err := s.cache.backend.Store(s.content.URI(), BackendEntry{ Modtime: v.info.Modtime, Data: v.buf.data })
+	if err != nil {
+		s.cache.logger.Printf("cache backend: error storing \"%s\": %v\n", s.content.URI(), err)
+	}
+}
+
+// deleteBackend removes the content from the backend
+func (s *cacheStorage) deleteBackend() {
+	err := s.cache.backend.Delete(s.content.URI())
+	if err != nil && !errors.Is(err, ErrBackendMiss) {
+		s.cache.logger.Printf("cache backend: error deleting \"%s\": %v\n", s.content.URI(), err)
+	}
+}
+
+type memoryBackend struct {
+	mutex    sync.Mutex
+	maxBytes int
+	used     int
+	entries  map[string]*memoryBackendEntry
+}
+
+type memoryBackendEntry struct {
+	BackendEntry
+	lastAccess int64
+}
+
+// NewMemoryBackend returns a Backend keeping up to maxBytes of contents
+// in the process memory (without limit if 0), evicting the least recently
+// used ones, and it can be shared between multiple caches. The memory is
+// not part of the memory budget of the caches (see MemoryBudgetOption),
+// so the contents evicted from a cache are still kept here
+func NewMemoryBackend(maxBytes int) Backend {
+	return &memoryBackend{
+		maxBytes: maxBytes,
+		entries:  make(map[string]*memoryBackendEntry),
+	}
+}
+
+func (b *memoryBackend) Load(key string) (BackendEntry, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	entry := b.entries[key]
+	if entry == nil {
+		return BackendEntry{}, ErrBackendMiss
+	}
+
+	entry.lastAccess = time.Now().UnixNano()
+	return entry.BackendEntry, nil
+}
+
+// Store keeps the data without copying it, as the cached data
+// is never modified. The entries bigger than the limit are not stored
+func (b *memoryBackend) Store(key string, entry BackendEntry) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.delete(key)
+	if b.maxBytes > 0 && len(entry.Data) > b.maxBytes {
+		return nil
+	}
+
+	b.entries[key] = &memoryBackendEntry{ BackendEntry: entry, lastAccess: time.Now().UnixNano() }
+	b.used += len(entry.Data)
+
+	for b.maxBytes > 0 && b.used > b.maxBytes {
+		var oldest string
+		for k, e := range b.entries {
+			if k != key && (oldest == "" || e.lastAccess < b.entries[oldest].lastAccess) {
+				oldest = k
+			}
+		}
+		if oldest == "" {
+			break
+		}
+
+		b.delete(oldest)
+	}
+
+	return nil
+}
+
+func (b *memoryBackend) Delete(key string) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.delete(key)
+	return nil
+}
+
+func (b *memoryBackend) delete(key string) {
+	if entry := b.entries[key]; entry != nil {
+		b.used -= len(entry.Data)
+		delete(b.entries, key)
+	}
+}
+
+type diskBackend struct {
+	dir string
+}
+
+// NewDiskBackend returns a Backend spilling the contents to files inside
+// dir, so that the contents evicted from memory are not read again from
+// their source and they survive a restart
+func NewDiskBackend(dir string) (Backend, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, fmt.Errorf("disk backend: %w", err)
+	}
+
+	return &diskBackend{ dir: dir }, nil
+}
+
+func (b *diskBackend) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(b.dir, hex.EncodeToString(sum[:]))
+}
+
+func (b *diskBackend) Load(key string) (BackendEntry, error) {
+	data, err := os.ReadFile(b.path(key))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return BackendEntry{}, ErrBackendMiss
+		}
+		return BackendEntry{}, err
+	}
+
+	return decodeBackendEntry(data)
+}
+
+// Store writes the entry to a temporary file and then renames it, so
+// that a concurrent Load never reads a partial entry
+func (b *diskBackend) Store(key string, entry BackendEntry) error {
+	f, err := os.CreateTemp(b.dir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(encodeBackendEntry(entry))
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), b.path(key))
+	}
+
+	if err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+func (b *diskBackend) Delete(key string) error {
+	err := os.Remove(b.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// KVStore is a key-value store, for example the client of a Redis or
+// Memcached server shared by multiple instances
+type KVStore interface {
+	// Get returns a nil value if the key is not present
+	Get(key string) ([]byte, error)
+	Set(key string, value []byte) error
+	Delete(key string) error
+}
+
+type kvBackend struct {
+	store  KVStore
+	prefix string
+}
+
+// NewKVBackend returns a Backend storing the contents in the key-value
+// store, with the keys prefixed by prefix so that different caches can
+// share the same store
+func NewKVBackend(store KVStore, prefix string) Backend {
+	return &kvBackend{ store: store, prefix: prefix }
+}
+
+func (b *kvBackend) Load(key string) (BackendEntry, error) {
+	value, err := b.store.Get(b.prefix + key)
+	if err != nil {
+		return BackendEntry{}, err
+	}
+	if value == nil {
+		return BackendEntry{}, ErrBackendMiss
+	}
+
+	return decodeBackendEntry(value)
+}
+
+func (b *kvBackend) Store(key string, entry BackendEntry) error {
+	return b.store.Set(b.prefix + key, encodeBackendEntry(entry))
+}
+
+func (b *kvBackend) Delete(key string) error {
+	return b.store.Delete(b.prefix + key)
+}
+
+type localKVStore struct {
+	mutex  sync.RWMutex
+	values map[string][]byte
+}
+
+// NewLocalKVStore returns a KVStore kept in the process memory, standing
+// in for a remote store during development and tests. The values are
+// copied like they would be sent over the network
+func NewLocalKVStore() KVStore {
+	return &localKVStore{ values: make(map[string][]byte) }
+}
+
+func (s *localKVStore) Get(key string) ([]byte, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	value, ok := s.values[key]
+	if !ok {
+		return nil, nil
+	}
+	return append([]byte{}, value...), nil
+}
+
+func (s *localKVStore) Set(key string, value []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.values[key] = append([]byte{}, value...)
+	return nil
+}
+
+func (s *localKVStore) Delete(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	delete(s.values, key)
+	return nil
+}
+
+// encodeBackendEntry encodes the entry as the modification time in
+// nanoseconds (0 for the zero time) followed by the data
+func encodeBackendEntry(entry BackendEntry) []byte {
+	b := make([]byte, 8, 8 + len(entry.Data))
+	if !entry.Modtime.IsZero() {
+		binary.BigEndian.PutUint64(b, uint64(entry.Modtime.UnixNano()))
+	}
+	return append(b, entry.Data...)
+}
+
+func decodeBackendEntry(b []byte) (BackendEntry, error) {
+	if len(b) < 8 {
+		return BackendEntry{}, errors.New("backend entry: invalid encoding")
+	}
+
+	var modtime time.Time
+	if nsec := int64(binary.BigEndian.Uint64(b)); nsec != 0 {
+		modtime = time.Unix(0, nsec)
+	}
+
+	return BackendEntry{ Modtime: modtime, Data: b[8:] }, nil
+}
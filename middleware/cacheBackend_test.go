@@ -0,0 +1,202 @@
+package middleware
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBackendRoundTrip(t *testing.T) {
+	disk, err := NewDiskBackend(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backends := map[string]Backend{
+		"memory": NewMemoryBackend(0),
+		"disk":   disk,
+		"kv":     NewKVBackend(NewLocalKVStore(), "cache:"),
+	}
+
+	entries := []BackendEntry{
+		{ Modtime: time.Unix(1700000000, 123456789), Data: []byte("hello world") },
+		{ Modtime: time.Unix(1700000000, 0), Data: []byte{} },
+		{ Data: []byte("no modtime") },
+	}
+
+	for name, b := range backends {
+		t.Run(name, func(t *testing.T) {
+			if _, err := b.Load("/missing"); !errors.Is(err, ErrBackendMiss) {
+				t.Errorf("missing key: error %v, want ErrBackendMiss", err)
+			}
+
+			for _, entry := range entries {
+				if err := b.Store("/key", entry); err != nil {
+					t.Fatal(err)
+				}
+
+				got, err := b.Load("/key")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !got.Modtime.Equal(entry.Modtime) || !bytes.Equal(got.Data, entry.Data) {
+					t.Errorf("loaded %v %q, want %v %q", got.Modtime, got.Data, entry.Modtime, entry.Data)
+				}
+			}
+
+			if err := b.Delete("/key"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := b.Load("/key"); !errors.Is(err, ErrBackendMiss) {
+				t.Errorf("deleted key: error %v, want ErrBackendMiss", err)
+			}
+			if err := b.Delete("/key"); err != nil {
+				t.Errorf("deleting a missing key: %v", err)
+			}
+		})
+	}
+}
+
+func TestDecodeBackendEntryInvalid(t *testing.T) {
+	if _, err := decodeBackendEntry([]byte("short")); err == nil {
+		t.Error("no error decoding a truncated entry")
+	}
+}
+
+func TestDiskBackendRestart(t *testing.T) {
+	dir := t.TempDir()
+	entry := BackendEntry{ Modtime: time.Unix(1700000000, 42), Data: []byte("persisted") }
+
+	b, err := NewDiskBackend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Store("/page.html", entry); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err = NewDiskBackend(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := b.Load("/page.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Modtime.Equal(entry.Modtime) || string(got.Data) != "persisted" {
+		t.Errorf("loaded %v %q after a restart", got.Modtime, got.Data)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, ".tmp-*"))
+	if len(files) != 0 {
+		t.Errorf("temporary files left behind: %v", files)
+	}
+}
+
+func TestMemoryBackendLimit(t *testing.T) {
+	b := NewMemoryBackend(10).(*memoryBackend)
+	store := func(key string, size int) {
+		t.Helper()
+		if err := b.Store(key, BackendEntry{ Data: make([]byte, size) }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	loaded := func(key string) bool {
+		_, err := b.Load(key)
+		return err == nil
+	}
+
+	store("/a", 4)
+	time.Sleep(time.Millisecond)
+	store("/b", 4)
+	time.Sleep(time.Millisecond)
+	loaded("/a")
+	time.Sleep(time.Millisecond)
+
+	// "/b" is the least recently used
+	store("/c", 4)
+	if !loaded("/a") || loaded("/b") || !loaded("/c") {
+		t.Errorf("wrong entry evicted: a %v, b %v, c %v", loaded("/a"), loaded("/b"), loaded("/c"))
+	}
+	if b.used > 10 {
+		t.Errorf("%d bytes used over the limit", b.used)
+	}
+
+	store("/big", 11)
+	if loaded("/big") {
+		t.Error("entry bigger than the limit stored")
+	}
+
+	// Replacing an entry releases its previous size
+	store("/a", 6)
+	if b.used != 10 {
+		t.Errorf("%d bytes used, want 10", b.used)
+	}
+}
+
+// TestCacheBackendValidation checks that a backend entry is used only if
+// it has the modification time and the size of the content
+func TestCacheBackendValidation(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "f.txt"), []byte("hello world"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(filepath.Join(dir, "f.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		entry BackendEntry
+		want  string
+	}{
+		{ "valid", BackendEntry{ Modtime: info.ModTime(), Data: []byte("HELLO WORLD") }, "HELLO WORLD" },
+		{ "modtime changed", BackendEntry{ Modtime: info.ModTime().Add(-time.Second), Data: []byte("HELLO WORLD") }, "hello world" },
+		{ "size changed", BackendEntry{ Modtime: info.ModTime(), Data: []byte("HELLO") }, "hello world" },
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			backend := NewMemoryBackend(0)
+			if err := backend.Store("/f.txt", tt.entry); err != nil {
+				t.Fatal(err)
+			}
+
+			c, err := NewCache(log.New(io.Discard, "", 0), dir, time.Minute, []string{ ".txt" }, BackendOption(backend))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			w := httptest.NewRecorder()
+			c.ServeContent(w, httptest.NewRequest(http.MethodGet, "/f.txt", nil), "/f.txt")
+			if got := w.Body.String(); got != tt.want {
+				t.Fatalf("served %q, want %q", got, tt.want)
+			}
+
+			if tt.want != "hello world" {
+				return
+			}
+
+			// The stale entry is replaced once the content is loaded
+			deadline := time.Now().Add(5 * time.Second)
+			for {
+				entry, err := backend.Load("/f.txt")
+				if err == nil && string(entry.Data) == "hello world" && entry.Modtime.Equal(info.ModTime()) {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("stale backend entry not replaced: %v %q", entry.Modtime, entry.Data)
+				}
+				time.Sleep(time.Millisecond)
+			}
+		})
+	}
+}
@@ -0,0 +1,308 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+var DefaultCompressExtensions = [...]string{ ".txt", ".html", ".css", ".js", ".mjs", ".json", ".webmanifest", ".xml", ".svg" }
+
+// Encoder is a content encoding the Cache can serve. Encoding is the
+// token used in the Accept-Encoding and Content-Encoding headers, Ext the
+// extension of the precompressed files on disk (for example "script.js.gz")
+// and NewWriter, if not nil, is used to compress the contents when they
+// are loaded
+type Encoder struct {
+	Encoding  string
+	Ext       string
+	NewWriter func(w io.Writer) (io.WriteCloser, error)
+}
+
+var (
+	GzipEncoder = Encoder{
+		Encoding: "gzip",
+		Ext:      ".gz",
+		NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriterLevel(w, gzip.BestCompression)
+		},
+	}
+	// BrotliEncoder only serves precompressed files, a NewWriter backed by
+	// a brotli implementation can be set to compress the contents too
+	BrotliEncoder = Encoder{ Encoding: "br", Ext: ".br" }
+	// ZstdEncoder only serves precompressed files, a NewWriter backed by
+	// a zstd implementation can be set to compress the contents too
+	ZstdEncoder = Encoder{ Encoding: "zstd", Ext: ".zst" }
+)
+
+// cacheCompression holds the configuration of the encoded variants
+type cacheCompression struct {
+	encoders      []Encoder
+	exts          []string
+	minSize       int
+	compress      bool
+	precompressed bool
+}
+
+func newCacheCompression() *cacheCompression {
+	return &cacheCompression{
+		encoders: []Encoder{ BrotliEncoder, ZstdEncoder, GzipEncoder },
+		exts:     DefaultCompressExtensions[:],
+	}
+}
+
+// CompressionOption compresses the contents with the given extensions
+// (see CompressExtensionsOption) of at least minSize bytes when they are
+// loaded, with every encoder having a NewWriter. The encoders are in order
+// of preference, and by default they are BrotliEncoder, ZstdEncoder and
+// GzipEncoder: only the ones serving precompressed files can be registered
+// without a NewWriter
+func CompressionOption(minSize int, encoders ...Encoder) Option {
+	return func(c *Cache) error {
+		if len(encoders) != 0 {
+			c.compression.encoders = encoders
+		}
+		c.compression.minSize = minSize
+		c.compression.compress = true
+		return nil
+	}
+}
+
+// CompressExtensionsOption sets the extensions of the contents compressed
+// when loaded, by default DefaultCompressExtensions
+func CompressExtensionsOption(exts ...string) Option {
+	return func(c *Cache) error {
+		c.compression.exts = exts
+		return nil
+	}
+}
+
+// PrecompressedOption serves the files found beside the cached ones with
+// the extension of an encoder (for example "style.css.br"), if they are
+// not older than the original file
+func PrecompressedOption() Option {
+	return func(c *Cache) error {
+		c.compression.precompressed = true
+		return nil
+	}
+}
+
+func (cc *cacheCompression) enabled() bool {
+	return cc.compress || cc.precompressed
+}
+
+// variants returns the encoded variants of the version, keyed by encoding
+func (cc *cacheCompression) variants(s *cacheStorage, v *cacheVersion, data []byte) map[string][]byte {
+	variants := make(map[string][]byte)
+
+	if cc.precompressed {
+		for _, enc := range cc.encoders {
+			if b := cc.precompressedFile(s, v, enc); b != nil {
+				variants[enc.Encoding] = b
+			}
+		}
+	}
+
+	if !cc.compress || len(data) < cc.minSize || !slices.Contains(cc.exts, filepath.Ext(s.content.Name())) {
+		return variants
+	}
+
+	for _, enc := range cc.encoders {
+		if enc.NewWriter == nil || variants[enc.Encoding] != nil {
+			continue
+		}
+
+		buf := new(bytes.Buffer)
+		w, err := enc.NewWriter(buf)
+		if err != nil {
+			s.cache.logger.Printf("error compressing \"%s\" with %s: %v\n", s.content.URI(), enc.Encoding, err)
+			continue
+		}
+
+		_, err = w.Write(data)
+		if closeErr := w.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			s.cache.logger.Printf("error compressing \"%s\" with %s: %v\n", s.content.URI(), enc.Encoding, err)
+			continue
+		}
+
+		// Not worth it, for example for already compressed formats
+		if buf.Len() < len(data) {
+			variants[enc.Encoding] = buf.Bytes()
+		}
+	}
+
+	return variants
+}
+
+// precompressedFile returns the data of the precompressed file beside
+// the file of the content, if any
+func (cc *cacheCompression) precompressedFile(s *cacheStorage, v *cacheVersion, enc Encoder) []byte {
+	content, _, ok := cc.precompressedContent(s, v, enc)
+	if !ok {
+		return nil
+	}
+
+	r, err := content.Reader()
+	if err != nil {
+		return nil
+	}
+	defer r.Close()
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return nil
+	}
+	return b
+}
+
+// precompressedContent returns the precompressed file beside the file
+// of the content, if it exists and it is not older than the original one
+func (cc *cacheCompression) precompressedContent(s *cacheStorage, v *cacheVersion, enc Encoder) (Content, ContentInfo, bool) {
+	f, ok := s.content.(fileContent)
+	if !ok || enc.Ext == "" {
+		return nil, ContentInfo{}, false
+	}
+
+	content := f.sibling(enc.Ext)
+	info, err := content.Info()
+	if err != nil || info.Modtime.Before(v.info.Modtime) {
+		return nil, ContentInfo{}, false
+	}
+
+	return content, info, true
+}
+
+// negotiate returns the preferred encoding accepted by the client between
+// the available ones, or an empty string for the identity
+func (cc *cacheCompression) negotiate(acceptEncoding string, available func(encoding string) bool) string {
+	if acceptEncoding == "" {
+		return ""
+	}
+
+	accepted := make(map[string]float64)
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		token, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		token = strings.ToLower(strings.TrimSpace(token))
+		if token == "" {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		accepted[token] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, enc := range cc.encoders {
+		q, ok := accepted[enc.Encoding]
+		if !ok {
+			q, ok = accepted["*"]
+		}
+
+		if ok && q > bestQ && available(enc.Encoding) {
+			best, bestQ = enc.Encoding, q
+		}
+	}
+
+	return best
+}
+
+// serveVariant serves the encoded variant of the content preferred by the
+// client, reporting whether the response has been sent
+func (c *Cache) serveVariant(w http.ResponseWriter, r *http.Request, cs *cacheStorage, v *cacheVersion) bool {
+	if !c.compression.enabled() {
+		return false
+	}
+
+	// The variants could be still loading, so the response
+	// varies even if they are not available yet
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	variants := v.variants.Load()
+	if variants == nil || len(*variants) == 0 {
+		return false
+	}
+
+	encoding := c.compression.negotiate(r.Header.Get("Accept-Encoding"), func(encoding string) bool {
+		return (*variants)[encoding] != nil
+	})
+	if encoding == "" {
+		return false
+	}
+
+	data := (*variants)[encoding]
+	v.setETag(w, encoding)
+	w.Header().Set("Content-Encoding", encoding)
+	setEncodedLength(w, r, len(data))
+	http.ServeContent(w, r, cs.content.Name(), v.info.Modtime, bytes.NewReader(data))
+	return true
+}
+
+// servePrecompressed serves the precompressed file of a content not kept
+// in memory, reporting whether the response has been sent
+func (c *Cache) servePrecompressed(w http.ResponseWriter, r *http.Request, cs *cacheStorage, v *cacheVersion) bool {
+	cc := c.compression
+	if !cc.precompressed {
+		return false
+	}
+
+	type precompressed struct {
+		content Content
+		info    ContentInfo
+	}
+
+	files := make(map[string]precompressed)
+	for _, enc := range cc.encoders {
+		if content, info, ok := cc.precompressedContent(cs, v, enc); ok {
+			files[enc.Encoding] = precompressed{ content, info }
+		}
+	}
+	if len(files) == 0 {
+		return false
+	}
+
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	encoding := cc.negotiate(r.Header.Get("Accept-Encoding"), func(encoding string) bool {
+		_, ok := files[encoding]
+		return ok
+	})
+	if encoding == "" {
+		return false
+	}
+
+	file := files[encoding]
+	reader, err := file.content.Reader()
+	if err != nil {
+		return false
+	}
+	defer reader.Close()
+
+	w.Header().Set("Content-Encoding", encoding)
+	setEncodedLength(w, r, file.info.Size)
+	http.ServeContent(w, r, cs.content.Name(), v.info.Modtime, reader)
+	return true
+}
+
+// setEncodedLength sets the Content-Length of an encoded body, as
+// http.ServeContent does not set it when Content-Encoding is present.
+// With a Range header only a part of the body could be sent, so the
+// length is left to be omitted
+func setEncodedLength(w http.ResponseWriter, r *http.Request, size int) {
+	if r.Header.Get("Range") != "" {
+		return
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(size))
+}
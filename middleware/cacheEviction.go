@@ -0,0 +1,239 @@
+package middleware
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nixpare/nix/utility"
+)
+
+// EvictionPolicy selects which content is removed from memory when the
+// memory budget of the Cache is exceeded
+type EvictionPolicy int
+
+const (
+	// EVICTION_LRU evicts the least recently served content
+	EVICTION_LRU EvictionPolicy = iota
+	// EVICTION_LFU evicts the least frequently served content, and
+	// between the ones served the same number of times the least
+	// recently served
+	EVICTION_LFU
+)
+
+func (p EvictionPolicy) String() string {
+	switch p {
+	case EVICTION_LRU:
+		return "LRU"
+	case EVICTION_LFU:
+		return "LFU"
+	default:
+		return "unknown"
+	}
+}
+
+// cacheMemory keeps track of the memory used by the loaded contents and
+// the stored responses
+type cacheMemory struct {
+	mutex        sync.Mutex
+	budget       int
+	policy       EvictionPolicy
+	maxEntrySize int
+	used         int
+	loaded       map[memoryEntry]int
+	evictions    uint64
+	evictedBytes uint64
+}
+
+// memoryEntry is an entry whose memory is accounted by cacheMemory
+type memoryEntry interface {
+	// usage returns the time of the last access, in nanoseconds, and
+	// the number of accesses
+	usage() (int64, uint64)
+	// evictable returns the state of the entry to evict, reporting
+	// whether the entry can be evicted now
+	evictable() (any, bool)
+	// evict removes the entry from memory if it is still in the given
+	// state, reporting whether it was evicted
+	evict(state any) bool
+}
+
+// MemoryBudgetOption limits the memory used by the cached contents to
+// maxBytes: when exceeded, the contents are evicted from memory following
+// the policy and loaded again when requested. Contents bigger than the
+// budget are always served from their source
+func MemoryBudgetOption(maxBytes int, policy EvictionPolicy) Option {
+	return func(c *Cache) error {
+		if maxBytes < 0 {
+			return fmt.Errorf("memory budget option: negative budget")
+		}
+
+		c.memory.budget = maxBytes
+		c.memory.policy = policy
+		return nil
+	}
+}
+
+// MaxEntrySizeOption sets the maximum size of a content kept in memory,
+// bigger contents are served from their source
+func MaxEntrySizeOption(maxBytes int) Option {
+	return func(c *Cache) error {
+		if maxBytes < 0 {
+			return fmt.Errorf("max entry size option: negative size")
+		}
+
+		c.memory.maxEntrySize = maxBytes
+		return nil
+	}
+}
+
+// fits reports whether a content of the given size can be kept in memory
+func (m *cacheMemory) fits(size int) bool {
+	if m.maxEntrySize > 0 && size > m.maxEntrySize {
+		return false
+	}
+	if m.budget > 0 && size > m.budget {
+		return false
+	}
+	return true
+}
+
+// reserve accounts the memory for the content being loaded, evicting
+// the other contents until the usage is within the budget
+func (m *cacheMemory) reserve(s memoryEntry, size int) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.used += size - m.loaded[s]
+	m.loaded[s] = size
+	m.evict(s)
+}
+
+// reserveChunks accounts the memory used by the chunks of the content,
+// evicting the other contents until the usage is within the budget
+func (m *cacheMemory) reserveChunks(s *cacheStorage, chunks *cacheChunks) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// The chunks could have been replaced in the meantime
+	if v := s.version.Load(); v == nil || v.chunks != chunks {
+		return
+	}
+
+	_, size := chunks.bytes()
+	m.used += size - m.loaded[s]
+	m.loaded[s] = size
+	m.evict(s)
+}
+
+// evict removes the contents from memory until the usage is within
+// the budget, without touching the one being loaded
+func (m *cacheMemory) evict(loading memoryEntry) {
+	for m.budget > 0 && m.used > m.budget {
+		victim, state := m.victim(loading)
+		if victim == nil {
+			break
+		}
+
+		evicted := m.loaded[victim]
+		m.used -= evicted
+		delete(m.loaded, victim)
+
+		if victim.evict(state) {
+			m.evictions++
+			m.evictedBytes += uint64(evicted)
+		}
+	}
+}
+
+// release removes the content from the memory accounting
+func (m *cacheMemory) release(s memoryEntry) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.used -= m.loaded[s]
+	delete(m.loaded, s)
+}
+
+// reset removes every content from the memory accounting
+func (m *cacheMemory) reset() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.used = 0
+	clear(m.loaded)
+}
+
+// victim returns the entry to evict following the policy, ignoring the
+// one being loaded and the ones that cannot be evicted now
+func (m *cacheMemory) victim(loading memoryEntry) (memoryEntry, any) {
+	var victim memoryEntry
+	var victimState any
+	for e := range m.loaded {
+		if e == loading {
+			continue
+		}
+
+		state, ok := e.evictable()
+		if !ok {
+			continue
+		}
+
+		if victim == nil || m.before(e, victim) {
+			victim, victimState = e, state
+		}
+	}
+
+	return victim, victimState
+}
+
+// before reports whether a must be evicted before b
+func (m *cacheMemory) before(a memoryEntry, b memoryEntry) bool {
+	lastA, accessesA := a.usage()
+	lastB, accessesB := b.usage()
+
+	if m.policy == EVICTION_LFU && accessesA != accessesB {
+		return accessesA < accessesB
+	}
+	return lastA < lastB
+}
+
+// touch records an access to the content
+func (s *cacheStorage) touch() {
+	s.lastAccess.Store(time.Now().UnixNano())
+}
+
+func (s *cacheStorage) usage() (int64, uint64) {
+	return s.lastAccess.Load(), s.stats.requests()
+}
+
+// evictable returns the current version, if fully loaded
+func (s *cacheStorage) evictable() (any, bool) {
+	v := s.version.Load()
+	if v == nil || (v.chunks == nil && (v.buf == nil || !v.buf.complete())) {
+		return nil, false
+	}
+	return v, true
+}
+
+// evict drops the version from memory: the readers still using it are
+// not affected, while a version loaded in the meantime accounts its
+// memory by itself
+func (s *cacheStorage) evict(state any) bool {
+	return s.version.CompareAndSwap(state.(*cacheVersion), nil)
+}
+
+func (m *cacheMemory) dumpStatus() string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	status := "Memory: " + utility.PrintBytes(m.used)
+	if m.budget > 0 {
+		status += fmt.Sprintf(" / %s (%s)", utility.PrintBytes(m.budget), m.policy)
+	}
+	if m.maxEntrySize > 0 {
+		status += " - Max Entry Size: " + utility.PrintBytes(m.maxEntrySize)
+	}
+
+	return status + fmt.Sprintf(" - Evictions: %d (%s)", m.evictions, utility.PrintBytes(int(m.evictedBytes)))
+}
@@ -1,9 +1,12 @@
 package middleware
 
 import (
+	"bytes"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
+	pathpkg "path"
 	"path/filepath"
 	"strings"
 )
@@ -55,3 +58,95 @@ func (f cachedFile) Reader() (io.ReadSeekCloser, error) {
 	
 	return file, nil
 }
+
+// sibling returns the file with the same path plus the extension
+func (f cachedFile) sibling(ext string) Content {
+	return cachedFile{
+		uri: f.uri + ext,
+		path: f.path + ext,
+	}
+}
+
+type fsFile struct {
+	uri string
+	fsys fs.FS
+	name string
+}
+
+// NewFSFile returns a Content backed by the file with the given path
+// inside fsys, for example an embed.FS
+func NewFSFile(uri string, fsys fs.FS, path string) Content {
+	name := strings.TrimPrefix(pathpkg.Clean("/" + filepath.ToSlash(path)), "/")
+	if name == "" {
+		name = "."
+	}
+
+	return fsFile{
+		uri: uri,
+		fsys: fsys,
+		name: name,
+	}
+}
+
+func (f fsFile) URI() string {
+	return f.uri
+}
+
+func (f fsFile) Name() string {
+	return pathpkg.Base(f.name)
+}
+
+func (f fsFile) Info() (cInfo ContentInfo, err error) {
+	info, err := fs.Stat(f.fsys, f.name)
+	if err != nil {
+		err = fmt.Errorf("stat: %w", err)
+		return
+	}
+
+	cInfo = ContentInfo{ Modtime: info.ModTime(), Size: int(info.Size()) }
+	return
+}
+
+func (f fsFile) Reader() (io.ReadSeekCloser, error) {
+	file, err := f.fsys.Open(f.name)
+	if err != nil {
+		return nil, err
+	}
+
+	if rsc, ok := file.(io.ReadSeekCloser); ok {
+		return rsc, nil
+	}
+
+	// The file system does not provide seekable files, so
+	// the whole file is read in memory
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, err
+	}
+	return nopSeekCloser{ bytes.NewReader(data) }, nil
+}
+
+func (f fsFile) sibling(ext string) Content {
+	return fsFile{
+		uri: f.uri + ext,
+		fsys: f.fsys,
+		name: f.name + ext,
+	}
+}
+
+// fileContent is implemented by the contents backed by a file,
+// which can have precompressed siblings
+type fileContent interface {
+	Content
+	sibling(ext string) Content
+}
+
+type nopSeekCloser struct {
+	io.ReadSeeker
+}
+
+func (nopSeekCloser) Close() error {
+	return nil
+}
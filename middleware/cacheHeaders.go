@@ -0,0 +1,88 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// cacheControlRule sets the Cache-Control header of the contents
+// matching the pattern
+type cacheControlRule struct {
+	pattern string
+	value   string
+}
+
+// CacheControlOption adds a rule setting the Cache-Control header of the
+// contents matching the pattern to value. The pattern can be an extension
+// (".html"), a path prefix ending with a slash ("/assets/") or a pattern
+// matched against the whole URI with path.Match ("/assets/*.js"). The rules
+// are checked in the order they are added and only the first matching one
+// is applied, for example:
+//
+//	CacheControlOption("/assets/", "public, max-age=31536000, immutable")
+//	CacheControlOption(".html", "no-cache")
+func CacheControlOption(pattern string, value string) Option {
+	return func(c *Cache) error {
+		if !strings.HasPrefix(pattern, ".") && !strings.HasSuffix(pattern, "/") {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return err
+			}
+		}
+
+		c.cacheControl = append(c.cacheControl, cacheControlRule{ pattern: pattern, value: value })
+		return nil
+	}
+}
+
+func (rule cacheControlRule) match(uri string, name string) bool {
+	switch {
+	case strings.HasPrefix(rule.pattern, "."):
+		return path.Ext(name) == rule.pattern
+	case strings.HasSuffix(rule.pattern, "/"):
+		return strings.HasPrefix(uri, rule.pattern)
+	default:
+		ok, _ := path.Match(rule.pattern, uri)
+		return ok
+	}
+}
+
+// setCacheControl sets the Cache-Control header following the first
+// rule matching the content, if any
+func (c *Cache) setCacheControl(w http.ResponseWriter, uri string, name string) {
+	for _, rule := range c.cacheControl {
+		if rule.match(uri, name) {
+			w.Header().Set("Cache-Control", rule.value)
+			return
+		}
+	}
+}
+
+// computeETag returns the strong entity tag of the data
+func computeETag(data []byte) string {
+	sum := sha256.Sum256(data)
+	return `"` + base64.RawURLEncoding.EncodeToString(sum[:18]) + `"`
+}
+
+// variantETag returns the entity tag of an encoded variant, which must be
+// different from the one of the content to be a strong validator
+func variantETag(etag string, encoding string) string {
+	return strings.TrimSuffix(etag, `"`) + "-" + encoding + `"`
+}
+
+// setETag sets the ETag header if the version has been fully loaded, so
+// that http.ServeContent can handle the If-None-Match and If-Match headers
+func (v *cacheVersion) setETag(w http.ResponseWriter, encoding string) {
+	etag := v.etag.Load()
+	if etag == nil {
+		return
+	}
+
+	if encoding == "" {
+		w.Header().Set("ETag", *etag)
+	} else {
+		w.Header().Set("ETag", variantETag(*etag, encoding))
+	}
+}
@@ -0,0 +1,228 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// preloadConfig holds the configuration of the preload done when the
+// Cache is created
+type preloadConfig struct {
+	workers int
+	include []string
+	exclude []string
+}
+
+// PreloadOption preloads the files matching the globs once the Cache is
+// created, see Cache.Preload. If any file cannot be loaded, the creation
+// of the Cache fails
+func PreloadOption(workers int, include []string, exclude []string) Option {
+	return func(c *Cache) error {
+		if err := validateGlobs(include, exclude); err != nil {
+			return fmt.Errorf("preload option: %w", err)
+		}
+
+		c.preload = &preloadConfig{ workers: workers, include: include, exclude: exclude }
+		return nil
+	}
+}
+
+// Preload walks the cache directory, or the fs.FS, and loads the files
+// with a cached extension matching any include glob and no exclude glob,
+// with at most workers files loaded concurrently (by default the number
+// of CPUs). Without include globs every file is matched. The globs are
+// matched against the slash separated path relative to the root: the ones
+// without a slash match the file name in any directory and "**" matches
+// any number of directories, for example "*.css", "assets/**/*.js" or
+// "docs/**". The errors of the files not loaded are joined together
+func (c *Cache) Preload(workers int, include []string, exclude []string) error {
+	if err := validateGlobs(include, exclude); err != nil {
+		return fmt.Errorf("cache preload: %w", err)
+	}
+
+	c.mutex.RLock()
+	disabled := c.disabled
+	c.mutex.RUnlock()
+
+	if disabled {
+		return fmt.Errorf("cache preload: %w", ErrCacheDisabled)
+	}
+
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	start := time.Now()
+	names := make(chan string)
+
+	var (
+		wg     sync.WaitGroup
+		mutex  sync.Mutex
+		errs   []error
+		loaded int
+	)
+
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for name := range names {
+				err := c.preloadFile(name)
+
+				mutex.Lock()
+				if err != nil {
+					errs = append(errs, fmt.Errorf("preload \"%s\": %w", name, err))
+				} else {
+					loaded++
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	err := fs.WalkDir(c.files(), ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			mutex.Lock()
+			errs = append(errs, err)
+			mutex.Unlock()
+
+			if d != nil && d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		if d.IsDir() || !c.preloadable(name, include, exclude) {
+			return nil
+		}
+
+		names <- name
+		return nil
+	})
+	close(names)
+	wg.Wait()
+
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	c.logger.Printf("cache preload: %d contents loaded in %v\n", loaded, time.Since(start).Round(time.Millisecond))
+
+	if len(errs) != 0 {
+		return fmt.Errorf("cache preload: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// files returns the file system the cache serves
+func (c *Cache) files() fs.FS {
+	if c.fsys != nil {
+		return c.fsys
+	}
+	return os.DirFS(c.dir)
+}
+
+func (c *Cache) preloadable(name string, include []string, exclude []string) bool {
+	ext := path.Ext(name)
+	if !slices.Contains(c.exts, ext) && !c.ranges.matchExt(ext) {
+		return false
+	}
+
+	if len(include) != 0 && !slices.ContainsFunc(include, func(glob string) bool {
+		return matchGlob(glob, name)
+	}) {
+		return false
+	}
+
+	return !slices.ContainsFunc(exclude, func(glob string) bool {
+		return matchGlob(glob, name)
+	})
+}
+
+// preloadFile loads the file with the uri ServeStatic would use for it
+// ("/about" for "about.html", "/docs" for "docs/index.html") and waits
+// for its data to be in memory
+func (c *Cache) preloadFile(name string) error {
+	uri := "/" + name
+	if path.Ext(name) == ".html" {
+		uri = strings.TrimSuffix(uri, ".html")
+		if path.Base(uri) == "index" {
+			uri = path.Dir(uri)
+		}
+	}
+
+	c.mutex.RLock()
+	cs := c.storage[uri]
+	c.mutex.RUnlock()
+
+	if cs == nil {
+		var err error
+		cs, _, _, err = c.getStaticFile(uri)
+		if err != nil {
+			return err
+		}
+		if cs == nil {
+			return fs.ErrNotExist
+		}
+	}
+
+	return cs.wait()
+}
+
+func validateGlobs(globs ...[]string) error {
+	for _, list := range globs {
+		for _, glob := range list {
+			for _, part := range strings.Split(glob, "/") {
+				if _, err := path.Match(part, ""); err != nil {
+					return fmt.Errorf("invalid glob \"%s\": %w", glob, err)
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// matchGlob reports whether the slash separated name matches the glob
+func matchGlob(glob string, name string) bool {
+	if !strings.Contains(glob, "/") {
+		ok, _ := path.Match(glob, path.Base(name))
+		return ok
+	}
+
+	return matchSegments(strings.Split(glob, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(glob []string, name []string) bool {
+	for len(glob) != 0 {
+		if glob[0] == "**" {
+			// "**" matches zero or more directories
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(glob[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(glob[0], name[0]); !ok {
+			return false
+		}
+
+		glob, name = glob[1:], name[1:]
+	}
+
+	return len(name) == 0
+}
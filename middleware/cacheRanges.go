@@ -0,0 +1,249 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+var DefaultRangeExtensions = [...]string{ ".mp4", ".webm", ".mkv", ".mov", ".ogv", ".mp3", ".ogg", ".oga", ".wav", ".flac", ".m4a" }
+
+// cacheRanges holds the configuration of the contents cached in chunks
+type cacheRanges struct {
+	chunkSize int
+	maxBytes  int
+	exts      []string
+}
+
+// RangeCacheOption caches in chunks of chunkSize bytes the files with the
+// given extensions (by default DefaultRangeExtensions) and the contents too
+// big to be kept entirely in memory: the chunks read by the clients, for
+// example with Range requests for a video, are kept in memory up to
+// maxBytesPerFile bytes for each file, evicting the least recently read
+// ones, while the others are read from the source
+func RangeCacheOption(chunkSize int, maxBytesPerFile int, exts ...string) Option {
+	return func(c *Cache) error {
+		if chunkSize <= 0 {
+			return errors.New("range cache option: chunk size must be positive")
+		}
+		if maxBytesPerFile < chunkSize {
+			return fmt.Errorf("range cache option: max bytes per file must be at least the chunk size")
+		}
+
+		if len(exts) == 0 {
+			exts = DefaultRangeExtensions[:]
+		}
+
+		c.ranges = &cacheRanges{
+			chunkSize: chunkSize,
+			maxBytes:  maxBytesPerFile,
+			exts:      exts,
+		}
+		return nil
+	}
+}
+
+// matchExt reports whether the files with the extension are cached in chunks
+func (cr *cacheRanges) matchExt(ext string) bool {
+	return cr != nil && slices.Contains(cr.exts, ext)
+}
+
+// cacheChunks holds the chunks of a content version kept in memory
+type cacheChunks struct {
+	mutex     sync.Mutex
+	info      ContentInfo
+	chunkSize int
+	maxBytes  int
+	chunks    map[int64]*cacheChunk
+	used      int
+}
+
+type cacheChunk struct {
+	data       []byte
+	lastAccess int64
+}
+
+func (cr *cacheRanges) newChunks(info ContentInfo) *cacheChunks {
+	return &cacheChunks{
+		info:      info,
+		chunkSize: cr.chunkSize,
+		maxBytes:  cr.maxBytes,
+		chunks:    make(map[int64]*cacheChunk),
+	}
+}
+
+// matches reports whether the chunks belong to the content version
+func (cc *cacheChunks) matches(info ContentInfo) bool {
+	return cc.info.Size == info.Size && cc.info.Modtime.Equal(info.Modtime)
+}
+
+func (cc *cacheChunks) get(index int64) []byte {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+
+	chunk := cc.chunks[index]
+	if chunk == nil {
+		return nil
+	}
+
+	chunk.lastAccess = time.Now().UnixNano()
+	return chunk.data
+}
+
+// put stores the chunk, evicting the least recently read ones if the
+// limit is exceeded, and reports whether it was stored
+func (cc *cacheChunks) put(index int64, data []byte) bool {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+
+	if cc.chunks[index] != nil || len(data) > cc.maxBytes {
+		return false
+	}
+
+	cc.chunks[index] = &cacheChunk{ data: data, lastAccess: time.Now().UnixNano() }
+	cc.used += len(data)
+
+	for cc.used > cc.maxBytes {
+		var oldest int64 = -1
+		for i, chunk := range cc.chunks {
+			if i != index && (oldest == -1 || chunk.lastAccess < cc.chunks[oldest].lastAccess) {
+				oldest = i
+			}
+		}
+		if oldest == -1 {
+			break
+		}
+
+		cc.used -= len(cc.chunks[oldest].data)
+		delete(cc.chunks, oldest)
+	}
+
+	return true
+}
+
+// bytes returns the number of chunks and the bytes kept in memory
+func (cc *cacheChunks) bytes() (int, int) {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+
+	return len(cc.chunks), cc.used
+}
+
+// chunkReader reads a content from its chunks in memory, reading the
+// missing ones from the source and storing them. The bytes read from the
+// chunks not in memory are counted in sourceBytes
+type chunkReader struct {
+	cs          *cacheStorage
+	chunks      *cacheChunks
+	source      io.ReadSeekCloser
+	offset      int64
+	sourceBytes int64
+}
+
+// Read is used to implement the io.Reader interface
+func (r *chunkReader) Read(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	size := int64(r.chunks.info.Size)
+	if r.offset >= size {
+		return 0, io.EOF
+	}
+
+	index := r.offset / int64(r.chunks.chunkSize)
+	data, cached, err := r.chunk(index)
+	if err != nil {
+		return 0, err
+	}
+
+	n = copy(p, data[r.offset - index * int64(r.chunks.chunkSize):])
+	r.offset += int64(n)
+	if !cached {
+		r.sourceBytes += int64(n)
+	}
+	return
+}
+
+// chunk returns the chunk with the index, reporting whether it was
+// already in memory
+func (r *chunkReader) chunk(index int64) ([]byte, bool, error) {
+	if data := r.chunks.get(index); data != nil {
+		return data, true, nil
+	}
+
+	if r.source == nil {
+		source, err := r.cs.content.Reader()
+		if err != nil {
+			return nil, false, err
+		}
+		r.source = source
+	}
+
+	start := index * int64(r.chunks.chunkSize)
+	if _, err := r.source.Seek(start, io.SeekStart); err != nil {
+		return nil, false, err
+	}
+
+	data := make([]byte, min(int64(r.chunks.chunkSize), int64(r.chunks.info.Size) - start))
+	if _, err := io.ReadFull(r.source, data); err != nil {
+		return nil, false, fmt.Errorf("chunk reader: %w", err)
+	}
+
+	if r.chunks.put(index, data) {
+		r.cs.cache.memory.reserveChunks(r.cs, r.chunks)
+	}
+	return data, false, nil
+}
+
+// Seek is used to implement the io.Seeker interface
+func (r *chunkReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += int64(r.chunks.info.Size)
+	default:
+		return 0, errors.New("chunk reader seek: invalid whence")
+	}
+
+	if offset < 0 {
+		return 0, errors.New("chunk reader seek: negative position")
+	}
+
+	r.offset = offset
+	return r.offset, nil
+}
+
+func (r *chunkReader) Close() error {
+	if r.source == nil {
+		return nil
+	}
+	return r.source.Close()
+}
+
+// serveChunks serves a content cached in chunks, reporting whether the
+// response has been sent and the bytes read from the source
+func (c *Cache) serveChunks(w http.ResponseWriter, r *http.Request, cs *cacheStorage, v *cacheVersion) (int64, bool) {
+	chunks := v.chunks
+	if chunks == nil {
+		return 0, false
+	}
+
+	reader := &chunkReader{ cs: cs, chunks: chunks }
+	defer reader.Close()
+
+	http.ServeContent(w, r, cs.content.Name(), chunks.info.Modtime, reader)
+	return reader.sourceBytes, true
+}
+
+// isChunked reports whether the content is cached in chunks
+func (c *Cache) isChunked(content Content) bool {
+	return c.ranges.matchExt(filepath.Ext(content.Name()))
+}
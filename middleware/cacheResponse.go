@@ -0,0 +1,750 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/nixpare/nix/utility"
+)
+
+// cacheable_statuses are the status codes of the responses stored by a
+// ResponseCache, following RFC 9111
+var cacheable_statuses = [...]int{ 200, 203, 204, 300, 301, 308, 404, 405, 410, 414, 501 }
+
+// ResponseCache caches the responses of any handler inside a Cache, keyed
+// by method, host, URL and the values of the Vary headers. The freshness
+// of a response follows its Cache-Control (s-maxage and max-age) and
+// Expires headers, or the TTL of the Cache when they are missing. The
+// responses with Cache-Control no-store, no-cache or private, with a
+// Set-Cookie header or with Vary "*" are never stored. The stored responses
+// count in the memory budget of the Cache (see MemoryBudgetOption) and are
+// evicted like the contents, they are removed once they cannot be served
+// anymore even as stale, and they are listed by Cache.DumpStatus and
+// removed by Cache.UpdateCache and Cache.UpdateContent
+type ResponseCache struct {
+	cache                *Cache
+	vary                 []string
+	staleWhileRevalidate time.Duration
+	staleIfError         time.Duration
+}
+
+type ResponseCacheOption func(rc *ResponseCache) error
+
+// responseGroup holds the responses of the same method and URL, one for
+// each combination of the values of the Vary headers
+type responseGroup struct {
+	vary       []string
+	responses  map[string]*cachedResponse
+	refreshing map[string]bool
+}
+
+// cachedResponse is a stored response, never modified once stored apart
+// from its expiration
+type cachedResponse struct {
+	cache           *Cache
+	key             string
+	vk              string
+	status          int
+	header          http.Header
+	body            []byte
+	stored          time.Time
+	expires         atomic.Int64
+	staleRevalidate time.Duration
+	staleError      time.Duration
+	hits            atomic.Uint64
+	lastAccess      atomic.Int64
+}
+
+// responseSweepInterval is the minimum interval between the removals of
+// the responses that cannot be served anymore
+const responseSweepInterval = time.Minute
+
+// NewResponseCache returns a ResponseCache storing the responses in the Cache
+func (c *Cache) NewResponseCache(opts ...ResponseCacheOption) (*ResponseCache, error) {
+	rc := &ResponseCache{ cache: c }
+
+	for _, opt := range opts {
+		err := opt(rc)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return rc, nil
+}
+
+// ResponseVaryOption adds the request headers that select different
+// responses for the same URL, beside the ones listed by the Vary header
+// of the responses
+func ResponseVaryOption(headers ...string) ResponseCacheOption {
+	return func(rc *ResponseCache) error {
+		for _, h := range headers {
+			rc.vary = append(rc.vary, textproto.CanonicalMIMEHeaderKey(h))
+		}
+		return nil
+	}
+}
+
+// StaleWhileRevalidateOption serves the responses expired for less than d
+// while they are refreshed in the background, when the response does not
+// set the stale-while-revalidate directive. The handler is called with a
+// copy of the request, so it must not rely on anything bound to the
+// original one
+func StaleWhileRevalidateOption(d time.Duration) ResponseCacheOption {
+	return func(rc *ResponseCache) error {
+		if d < 0 {
+			return errors.New("stale while revalidate option: negative duration")
+		}
+
+		rc.staleWhileRevalidate = d
+		return nil
+	}
+}
+
+// StaleIfErrorOption serves the responses expired for less than d when
+// the handler fails with a 5xx status code, when the response does not
+// set the stale-if-error directive
+func StaleIfErrorOption(d time.Duration) ResponseCacheOption {
+	return func(rc *ResponseCache) error {
+		if d < 0 {
+			return errors.New("stale if error option: negative duration")
+		}
+
+		rc.staleIfError = d
+		return nil
+	}
+}
+
+// Handler returns a handler serving the responses of next from the cache
+func (rc *ResponseCache) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc.Serve(w, r, next)
+	})
+}
+
+// Serve serves the response of next for the request from the cache,
+// calling next if there is no fresh response stored
+func (rc *ResponseCache) Serve(w http.ResponseWriter, r *http.Request, next http.Handler) {
+	c := rc.cache
+
+	c.mutex.RLock()
+	disabled := c.disabled
+	c.mutex.RUnlock()
+
+	if disabled || (r.Method != http.MethodGet && r.Method != http.MethodHead) ||
+		strings.Contains(r.Header.Get("Cache-Control"), "no-store") {
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	key := responseKey(r)
+	resp, vk := rc.lookup(key, r)
+	now := time.Now()
+
+	if resp != nil {
+		expires := time.Unix(0, resp.expires.Load())
+
+		if now.Before(expires) {
+			rc.serve(w, r, resp, now)
+			return
+		}
+
+		if now.Before(expires.Add(resp.staleRevalidate)) {
+			rc.serve(w, r, resp, now)
+			rc.revalidate(key, vk, r, next)
+			return
+		}
+	}
+
+	// Only the responses to GET requests are stored, while HEAD
+	// requests can be served from them
+	if r.Method == http.MethodHead {
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	staleError := resp != nil && now.Before(time.Unix(0, resp.expires.Load()).Add(resp.staleError))
+
+	rec := rc.newResponseRecorder(w, r, staleError)
+	next.ServeHTTP(rec, r)
+
+	// The response has already been sent
+	if rec.passthrough {
+		return
+	}
+
+	if rec.status >= 500 && staleError {
+		rc.serve(w, r, resp, now)
+		return
+	}
+
+	rc.store(key, r, rec, now)
+	rec.writeTo(w)
+}
+
+// responseKey returns the key of the responses to the request
+func responseKey(r *http.Request) string {
+	return "GET " + r.Host + r.URL.RequestURI()
+}
+
+// responsePath returns the path of the responses with the key
+func responsePath(key string) string {
+	i := strings.Index(key, "/")
+	if i < 0 {
+		return ""
+	}
+
+	path, _, _ := strings.Cut(key[i:], "?")
+	return path
+}
+
+// varyKey returns the values of the headers of the request
+func varyKey(r *http.Request, vary []string) string {
+	var sb strings.Builder
+	for _, h := range vary {
+		sb.WriteString(h)
+		sb.WriteByte('=')
+		sb.WriteString(strings.Join(r.Header.Values(h), ","))
+		sb.WriteByte('\n')
+	}
+	return sb.String()
+}
+
+func (rc *ResponseCache) lookup(key string, r *http.Request) (*cachedResponse, string) {
+	c := rc.cache
+
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	group := c.responses[key]
+	if group == nil {
+		return nil, ""
+	}
+
+	vk := varyKey(r, group.vary)
+	return group.responses[vk], vk
+}
+
+// revalidate refreshes the response in the background, if no other
+// goroutine is already refreshing it
+func (rc *ResponseCache) revalidate(key string, vk string, r *http.Request, next http.Handler) {
+	c := rc.cache
+
+	c.mutex.Lock()
+	group := c.responses[key]
+	if group == nil || group.refreshing[vk] {
+		c.mutex.Unlock()
+		return
+	}
+	group.refreshing[vk] = true
+	c.mutex.Unlock()
+
+	r = r.Clone(context.WithoutCancel(r.Context()))
+	r.Method = http.MethodGet
+
+	go func() {
+		defer func() {
+			c.mutex.Lock()
+			delete(group.refreshing, vk)
+			c.mutex.Unlock()
+
+			if err := recover(); err != nil {
+				c.logger.Printf("response cache: panic revalidating \"%s\": %v\n%s\n", key, err, debug.Stack())
+			}
+		}()
+
+		rec := rc.newResponseRecorder(nil, r, true)
+		next.ServeHTTP(rec, r)
+
+		// The stale response is kept when the handler fails
+		if rec.status >= 500 {
+			return
+		}
+		rc.store(key, r, rec, time.Now())
+	}()
+}
+
+// storable reports whether a response with the status and the header
+// can be stored, regardless of its size and its lifetime
+func (rc *ResponseCache) storable(r *http.Request, status int, header http.Header) bool {
+	if !slices.Contains(cacheable_statuses[:], status) || header.Get("Set-Cookie") != "" {
+		return false
+	}
+
+	directives := parseCacheControl(header.Get("Cache-Control"))
+	for _, name := range []string{ "no-store", "no-cache", "private" } {
+		if _, ok := directives[name]; ok {
+			return false
+		}
+	}
+	if _, ok := directives["public"]; !ok && r.Header.Get("Authorization") != "" {
+		if _, ok := directives["s-maxage"]; !ok {
+			return false
+		}
+	}
+
+	for _, value := range header.Values("Vary") {
+		for _, h := range strings.Split(value, ",") {
+			if strings.TrimSpace(h) == "*" {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// store stores the recorded response, if cacheable
+func (rc *ResponseCache) store(key string, r *http.Request, rec *responseRecorder, now time.Time) {
+	c := rc.cache
+
+	if !rc.storable(r, rec.status, rec.header) || !c.memory.fits(rec.body.Len()) {
+		return
+	}
+
+	directives := parseCacheControl(rec.header.Get("Cache-Control"))
+
+	vary := slices.Clone(rc.vary)
+	for _, value := range rec.header.Values("Vary") {
+		for _, h := range strings.Split(value, ",") {
+			h = textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(h))
+			if h != "" && !slices.Contains(vary, h) {
+				vary = append(vary, h)
+			}
+		}
+	}
+	slices.Sort(vary)
+
+	resp := &cachedResponse{
+		cache:           c,
+		key:             key,
+		vk:              varyKey(r, vary),
+		status:          rec.status,
+		header:          rec.header.Clone(),
+		body:            bytes.Clone(rec.body.Bytes()),
+		stored:          now,
+		staleRevalidate: directiveDuration(directives, "stale-while-revalidate", rc.staleWhileRevalidate),
+		staleError:      directiveDuration(directives, "stale-if-error", rc.staleIfError),
+	}
+
+	lifetime := rc.lifetime(directives, rec.header, now)
+	if lifetime <= 0 && resp.staleRevalidate == 0 && resp.staleError == 0 {
+		return
+	}
+	resp.expires.Store(now.Add(lifetime).UnixNano())
+	resp.lastAccess.Store(now.UnixNano())
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if now.After(c.responsesSweep) {
+		c.sweepResponses(now)
+		c.responsesSweep = now.Add(responseSweepInterval)
+	}
+
+	group := c.responses[key]
+	if group == nil || !slices.Equal(group.vary, vary) {
+		// The responses stored with different Vary headers cannot
+		// be selected anymore
+		refreshing := make(map[string]bool)
+		if group != nil {
+			refreshing = group.refreshing
+			for vk := range group.responses {
+				c.deleteResponse(key, group, vk)
+			}
+		}
+
+		group = &responseGroup{
+			vary:       vary,
+			responses:  make(map[string]*cachedResponse),
+			refreshing: refreshing,
+		}
+		c.responses[key] = group
+	}
+
+	if old := group.responses[resp.vk]; old != nil {
+		c.memory.release(old)
+	}
+	group.responses[resp.vk] = resp
+	c.memory.reserve(resp, len(resp.body))
+}
+
+// lifetime returns the freshness lifetime of the response
+func (rc *ResponseCache) lifetime(directives map[string]string, header http.Header, now time.Time) time.Duration {
+	for _, name := range []string{ "s-maxage", "max-age" } {
+		if value, ok := directives[name]; ok {
+			seconds, err := strconv.Atoi(value)
+			if err != nil {
+				return 0
+			}
+			return time.Duration(seconds) * time.Second
+		}
+	}
+
+	if value := header.Get("Expires"); value != "" {
+		expires, err := http.ParseTime(value)
+		if err != nil {
+			return 0
+		}
+
+		date := now
+		if d, err := http.ParseTime(header.Get("Date")); err == nil {
+			date = d
+		}
+		return expires.Sub(date)
+	}
+
+	return rc.cache.FileCacheTTL()
+}
+
+// serve writes the stored response
+func (rc *ResponseCache) serve(w http.ResponseWriter, r *http.Request, resp *cachedResponse, now time.Time) {
+	resp.hits.Add(1)
+	resp.lastAccess.Store(now.UnixNano())
+
+	header := w.Header()
+	for k, v := range resp.header {
+		header[k] = slices.Clone(v)
+	}
+	header.Set("Age", strconv.Itoa(int(now.Sub(resp.stored).Seconds())))
+	addVary(header, rc.vary)
+
+	// http.ServeContent handles the conditional and range requests,
+	// relying on the ETag and Last-Modified headers of the response
+	if resp.status == http.StatusOK {
+		modtime, _ := http.ParseTime(resp.header.Get("Last-Modified"))
+		header.Del("Content-Length")
+		if header.Get("Content-Encoding") != "" {
+			setEncodedLength(w, r, len(resp.body))
+		}
+		http.ServeContent(w, r, "", modtime, bytes.NewReader(resp.body))
+		return
+	}
+
+	header.Set("Content-Length", strconv.Itoa(len(resp.body)))
+	w.WriteHeader(resp.status)
+	if r.Method != http.MethodHead {
+		w.Write(resp.body)
+	}
+}
+
+// addVary adds the headers to the Vary header of the response, if
+// not already listed
+func addVary(header http.Header, vary []string) {
+	for _, h := range vary {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
+
+		found := false
+		for _, value := range header.Values("Vary") {
+			for _, v := range strings.Split(value, ",") {
+				if strings.EqualFold(strings.TrimSpace(v), h) {
+					found = true
+				}
+			}
+		}
+
+		if !found {
+			header.Add("Vary", h)
+		}
+	}
+}
+
+// purgeResponses removes the responses whose path matches, returning
+// the number of responses removed. The lock must be held
+func (c *Cache) purgeResponses(match func(path string) bool) int {
+	var n int
+	for key, group := range c.responses {
+		if !match(responsePath(key)) {
+			continue
+		}
+
+		for vk := range group.responses {
+			c.deleteResponse(key, group, vk)
+			n++
+		}
+	}
+
+	return n
+}
+
+// sweepResponses removes the responses that cannot be served anymore,
+// not even as stale. The lock must be held
+func (c *Cache) sweepResponses(now time.Time) {
+	for key, group := range c.responses {
+		for vk, resp := range group.responses {
+			if now.UnixNano() > resp.removal() {
+				c.deleteResponse(key, group, vk)
+			}
+		}
+	}
+}
+
+// deleteResponse removes the response from the group, and the group if
+// it is left empty. The lock must be held
+func (c *Cache) deleteResponse(key string, group *responseGroup, vk string) {
+	if resp := group.responses[vk]; resp != nil {
+		delete(group.responses, vk)
+		c.memory.release(resp)
+	}
+
+	if len(group.responses) == 0 && c.responses[key] == group {
+		delete(c.responses, key)
+	}
+}
+
+// removal returns the time, in nanoseconds, after which the response
+// cannot be served anymore
+func (resp *cachedResponse) removal() int64 {
+	return resp.expires.Load() + int64(max(resp.staleRevalidate, resp.staleError))
+}
+
+func (resp *cachedResponse) usage() (int64, uint64) {
+	return resp.lastAccess.Load(), resp.hits.Load()
+}
+
+func (resp *cachedResponse) evictable() (any, bool) {
+	return nil, true
+}
+
+// evict removes the response from the cache. The memory lock is held
+// while evicting, so the response is removed in the background as the
+// cache lock could be held by the caller
+func (resp *cachedResponse) evict(state any) bool {
+	go func() {
+		c := resp.cache
+
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+
+		group := c.responses[resp.key]
+		if group == nil || group.responses[resp.vk] != resp {
+			return
+		}
+
+		delete(group.responses, resp.vk)
+		if len(group.responses) == 0 {
+			delete(c.responses, resp.key)
+		}
+	}()
+
+	return true
+}
+
+func (c *Cache) dumpResponses(sb *strings.Builder) {
+	if len(c.responses) == 0 {
+		return
+	}
+
+	var n int
+	for _, group := range c.responses {
+		n += len(group.responses)
+	}
+
+	sb.WriteString("\n - Responses: ")
+	sb.WriteString(fmt.Sprint(n))
+
+	for key, group := range c.responses {
+		for vk, resp := range group.responses {
+			sb.WriteString("\n   - \"")
+			sb.WriteString(key)
+			sb.WriteString("\"")
+			if vk != "" {
+				sb.WriteString(" [")
+				sb.WriteString(strings.ReplaceAll(strings.TrimSuffix(vk, "\n"), "\n", ", "))
+				sb.WriteString("]")
+			}
+			sb.WriteString(" -> Status: ")
+			sb.WriteString(strconv.Itoa(resp.status))
+			sb.WriteString(" - Size: ")
+			sb.WriteString(utility.PrintBytes(len(resp.body)))
+			sb.WriteString(" - Hits: ")
+			sb.WriteString(fmt.Sprint(resp.hits.Load()))
+			sb.WriteString(" - Expiration: ")
+			sb.WriteString(time.Unix(0, resp.expires.Load()).Format(time.DateTime))
+		}
+	}
+}
+
+// parseCacheControl returns the directives of a Cache-Control header,
+// with the names in lower case
+func parseCacheControl(value string) map[string]string {
+	directives := make(map[string]string)
+	for _, part := range strings.Split(value, ",") {
+		name, arg, _ := strings.Cut(strings.TrimSpace(part), "=")
+		if name == "" {
+			continue
+		}
+		directives[strings.ToLower(name)] = strings.Trim(arg, `"`)
+	}
+	return directives
+}
+
+func directiveDuration(directives map[string]string, name string, def time.Duration) time.Duration {
+	value, ok := directives[name]
+	if !ok {
+		return def
+	}
+
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < 0 {
+		return def
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// responseRecorder records the response of a handler to store it. The
+// response is buffered only while it can be stored (or while it could be
+// replaced by a stale one, if it fails): otherwise, or when the handler
+// flushes it, hijacks the connection or unwraps the ResponseWriter, it is
+// passed through to w. Without w, as when revalidating in the background,
+// the response is always buffered
+type responseRecorder struct {
+	w           http.ResponseWriter
+	r           *http.Request
+	rc          *ResponseCache
+	staleError  bool
+	header      http.Header
+	status      int
+	wroteHeader bool
+	passthrough bool
+	body        bytes.Buffer
+}
+
+func (rc *ResponseCache) newResponseRecorder(w http.ResponseWriter, r *http.Request, staleError bool) *responseRecorder {
+	return &responseRecorder{
+		w:          w,
+		r:          r,
+		rc:         rc,
+		staleError: staleError,
+		header:     make(http.Header),
+		status:     http.StatusOK,
+	}
+}
+
+func (rec *responseRecorder) Header() http.Header {
+	if rec.passthrough {
+		return rec.w.Header()
+	}
+	return rec.header
+}
+
+func (rec *responseRecorder) WriteHeader(statusCode int) {
+	if rec.passthrough {
+		rec.w.WriteHeader(statusCode)
+		return
+	}
+	if rec.wroteHeader {
+		return
+	}
+
+	// The informational responses are sent right away
+	if statusCode >= 100 && statusCode < 200 && statusCode != http.StatusSwitchingProtocols {
+		if rec.w != nil {
+			rec.copyHeader(rec.w.Header())
+			rec.w.WriteHeader(statusCode)
+		}
+		return
+	}
+
+	rec.status = statusCode
+	rec.wroteHeader = true
+
+	if !(statusCode >= 500 && rec.staleError) && !rec.rc.storable(rec.r, statusCode, rec.header) {
+		rec.passThrough()
+	}
+}
+
+func (rec *responseRecorder) Write(p []byte) (int, error) {
+	if !rec.wroteHeader && !rec.passthrough {
+		rec.WriteHeader(http.StatusOK)
+	}
+
+	// A response too big to be stored is not buffered any further
+	if !rec.passthrough && rec.w != nil && !rec.rc.cache.memory.fits(rec.body.Len() + len(p)) {
+		rec.passThrough()
+	}
+
+	if rec.passthrough {
+		return rec.w.Write(p)
+	}
+	return rec.body.Write(p)
+}
+
+func (rec *responseRecorder) Flush() {
+	if rec.w == nil {
+		return
+	}
+
+	rec.passThrough()
+	http.NewResponseController(rec.w).Flush()
+}
+
+func (rec *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if rec.w == nil {
+		return nil, nil, errors.New("response cache: cannot hijack a background request")
+	}
+
+	rec.passThrough()
+	return http.NewResponseController(rec.w).Hijack()
+}
+
+// Unwrap returns the underlying ResponseWriter for http.ResponseController,
+// which can then write to it directly
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	rec.passThrough()
+	return rec.w
+}
+
+// passThrough sends what has been recorded so far and writes the rest
+// of the response directly to w
+func (rec *responseRecorder) passThrough() {
+	if rec.passthrough || rec.w == nil {
+		return
+	}
+	rec.passthrough = true
+
+	rec.copyHeader(rec.w.Header())
+	if rec.wroteHeader {
+		rec.w.WriteHeader(rec.status)
+		rec.w.Write(rec.body.Bytes())
+	}
+	rec.body = bytes.Buffer{}
+}
+
+// copyHeader copies the recorded header, merging its Vary header with
+// the one already set and the one of the ResponseCache
+func (rec *responseRecorder) copyHeader(header http.Header) {
+	for k, v := range rec.header {
+		if k == "Vary" {
+			continue
+		}
+		header[k] = v
+	}
+
+	addVary(header, rec.rc.vary)
+	for _, value := range rec.header.Values("Vary") {
+		addVary(header, strings.Split(value, ","))
+	}
+}
+
+// writeTo sends the recorded response
+func (rec *responseRecorder) writeTo(w http.ResponseWriter) {
+	rec.copyHeader(w.Header())
+	w.WriteHeader(rec.status)
+	w.Write(rec.body.Bytes())
+}
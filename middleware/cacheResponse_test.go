@@ -0,0 +1,194 @@
+package middleware
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newResponseTestCache(t *testing.T, opts ...ResponseCacheOption) *ResponseCache {
+	c, err := NewCache(log.New(io.Discard, "", 0), t.TempDir(), time.Minute, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rc, err := c.NewResponseCache(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rc
+}
+
+func getResponseTest(t *testing.T, url string) (*http.Response, string) {
+	t.Helper()
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(body)
+}
+
+func TestResponseCacheStore(t *testing.T) {
+	rc := newResponseTestCache(t, ResponseVaryOption("Accept-Language"))
+
+	var calls atomic.Int32
+	srv := httptest.NewServer(rc.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Vary", "Accept-Encoding")
+		w.Write([]byte("cached"))
+	})))
+	defer srv.Close()
+
+	for range 3 {
+		resp, body := getResponseTest(t, srv.URL)
+		if body != "cached" {
+			t.Errorf("body %q", body)
+		}
+		if vary := resp.Header.Values("Vary"); len(vary) != 2 {
+			t.Errorf("Vary header %q", vary)
+		}
+	}
+
+	if n := calls.Load(); n != 1 {
+		t.Errorf("handler called %d times, want 1", n)
+	}
+}
+
+// TestResponseCacheFlush checks that the flushed responses are sent while
+// the handler is still writing them
+func TestResponseCacheFlush(t *testing.T) {
+	for _, cc := range []string{ "max-age=60", "no-store" } {
+		t.Run(cc, func(t *testing.T) {
+			rc := newResponseTestCache(t)
+			release := make(chan struct{})
+
+			srv := httptest.NewServer(rc.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Cache-Control", cc)
+				w.Write([]byte("first\n"))
+				http.NewResponseController(w).Flush()
+
+				<-release
+				w.Write([]byte("second\n"))
+			})))
+			defer srv.Close()
+			defer close(release)
+
+			resp, err := http.Get(srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+
+			line := make(chan string)
+			go func() {
+				l, _ := bufio.NewReader(resp.Body).ReadString('\n')
+				line <- l
+			}()
+
+			select {
+			case l := <-line:
+				if l != "first\n" {
+					t.Errorf("first line %q", l)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("flushed response buffered by the cache")
+			}
+		})
+	}
+}
+
+func TestResponseCacheNotBuffered(t *testing.T) {
+	rc := newResponseTestCache(t)
+
+	var buffered bool
+	rec := httptest.NewRecorder()
+	rc.Serve(rec, httptest.NewRequest(http.MethodGet, "/", nil), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write([]byte("streamed"))
+
+		// The response is written to the client right away
+		buffered = rec.Body.String() != "streamed"
+	}))
+
+	if buffered {
+		t.Error("response that cannot be stored buffered by the cache")
+	}
+	if status := rc.cache.Status(); len(status.Responses) != 0 {
+		t.Errorf("%d responses stored", len(status.Responses))
+	}
+}
+
+func TestResponseCacheHijack(t *testing.T) {
+	rc := newResponseTestCache(t)
+
+	srv := httptest.NewServer(rc.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		brw.WriteString("HTTP/1.1 200 OK\r\nContent-Length: 8\r\nConnection: close\r\n\r\nhijacked")
+		brw.Flush()
+	})))
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: test\r\n\r\n"))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "hijacked" {
+		t.Errorf("body %q", body)
+	}
+}
+
+func TestResponseCacheStaleIfError(t *testing.T) {
+	rc := newResponseTestCache(t)
+
+	var failing atomic.Bool
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			http.Error(w, "failed", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=0, stale-if-error=60")
+		w.Write([]byte("stale"))
+	})
+
+	serve := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		rc.Serve(w, httptest.NewRequest(http.MethodGet, "/", nil), handler)
+		return w
+	}
+
+	serve()
+	failing.Store(true)
+
+	if w := serve(); w.Code != http.StatusOK || w.Body.String() != "stale" {
+		t.Errorf("failed response served instead of the stale one: %d %q", w.Code, w.Body.String())
+	}
+}
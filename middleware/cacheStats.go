@@ -0,0 +1,244 @@
+package middleware
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/nixpare/nix/utility"
+)
+
+// CacheEntryStats are the counters of the requests served by the cache.
+// A request is a hit if it is served from memory with the version of the
+// content already loaded, otherwise it is a miss: the content was not
+// cached yet, it has been evicted or changed, or it is read from its
+// source (because too big, streamed or the cache is disabled). Refreshes
+// are the versions loaded again after the first one, and errors are the
+// failures loading a content
+type CacheEntryStats struct {
+	Hits        uint64 `json:"hits"`
+	Misses      uint64 `json:"misses"`
+	Refreshes   uint64 `json:"refreshes"`
+	Errors      uint64 `json:"errors"`
+	MemoryBytes uint64 `json:"memory_bytes"`
+	DiskBytes   uint64 `json:"disk_bytes"`
+}
+
+// CacheExtensionStats are the counters of the requests of the files with
+// an extension. Skipped are the requests of files not cached because of
+// their extension, useful to tune the extensions of the cache
+type CacheExtensionStats struct {
+	CacheEntryStats
+	Skipped uint64 `json:"skipped"`
+}
+
+// CacheStats are the counters of a Cache since its creation, see Cache.Stats
+type CacheStats struct {
+	CacheEntryStats
+	Skipped    uint64                         `json:"skipped"`
+	NotFound   uint64                         `json:"not_found"`
+	Extensions map[string]CacheExtensionStats `json:"extensions"`
+}
+
+// HitRatio returns the ratio of the hits on the requests served by the cache
+func (s CacheEntryStats) HitRatio() float64 {
+	if s.Hits + s.Misses == 0 {
+		return 0
+	}
+	return float64(s.Hits) / float64(s.Hits + s.Misses)
+}
+
+// cacheCounters are the counters shared by the whole cache, each
+// extension and each content
+type cacheCounters struct {
+	hits        atomic.Uint64
+	misses      atomic.Uint64
+	refreshes   atomic.Uint64
+	errors      atomic.Uint64
+	skipped     atomic.Uint64
+	memoryBytes atomic.Uint64
+	diskBytes   atomic.Uint64
+}
+
+type cacheStats struct {
+	total    cacheCounters
+	notFound atomic.Uint64
+	mutex    sync.RWMutex
+	exts     map[string]*cacheCounters
+}
+
+func newCacheStats() *cacheStats {
+	return &cacheStats{ exts: make(map[string]*cacheCounters) }
+}
+
+// ext returns the counters of the extension, creating them if needed
+func (st *cacheStats) ext(ext string) *cacheCounters {
+	st.mutex.RLock()
+	cc := st.exts[ext]
+	st.mutex.RUnlock()
+
+	if cc != nil {
+		return cc
+	}
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if cc = st.exts[ext]; cc == nil {
+		cc = new(cacheCounters)
+		st.exts[ext] = cc
+	}
+	return cc
+}
+
+// served records a request of the content, with the bytes sent from
+// memory and from the source
+func (st *cacheStats) served(cs *cacheStorage, hit bool, memory int64, disk int64) {
+	for _, cc := range [...]*cacheCounters{ &st.total, st.ext(cs.ext()), &cs.stats } {
+		if hit {
+			cc.hits.Add(1)
+		} else {
+			cc.misses.Add(1)
+		}
+		cc.memoryBytes.Add(uint64(memory))
+		cc.diskBytes.Add(uint64(disk))
+	}
+}
+
+// skipped records a request of a file not cached because of its extension
+func (st *cacheStats) skipped(ext string, disk int64) {
+	for _, cc := range [...]*cacheCounters{ &st.total, st.ext(ext) } {
+		cc.skipped.Add(1)
+		cc.diskBytes.Add(uint64(disk))
+	}
+}
+
+func (st *cacheStats) refreshed(cs *cacheStorage) {
+	for _, cc := range [...]*cacheCounters{ &st.total, st.ext(cs.ext()), &cs.stats } {
+		cc.refreshes.Add(1)
+	}
+}
+
+func (st *cacheStats) failed(cs *cacheStorage) {
+	for _, cc := range [...]*cacheCounters{ &st.total, st.ext(cs.ext()), &cs.stats } {
+		cc.errors.Add(1)
+	}
+}
+
+func (cc *cacheCounters) entryStats() CacheEntryStats {
+	return CacheEntryStats{
+		Hits:        cc.hits.Load(),
+		Misses:      cc.misses.Load(),
+		Refreshes:   cc.refreshes.Load(),
+		Errors:      cc.errors.Load(),
+		MemoryBytes: cc.memoryBytes.Load(),
+		DiskBytes:   cc.diskBytes.Load(),
+	}
+}
+
+// requests returns the number of requests served by the cache
+func (cc *cacheCounters) requests() uint64 {
+	return cc.hits.Load() + cc.misses.Load()
+}
+
+// Stats returns the counters of the cache, globally and for each file
+// extension, while the counters of each content are in the Status
+func (c *Cache) Stats() CacheStats {
+	st := c.stats
+
+	stats := CacheStats{
+		CacheEntryStats: st.total.entryStats(),
+		Skipped:         st.total.skipped.Load(),
+		NotFound:        st.notFound.Load(),
+		Extensions:      make(map[string]CacheExtensionStats),
+	}
+
+	st.mutex.RLock()
+	defer st.mutex.RUnlock()
+
+	for ext, cc := range st.exts {
+		stats.Extensions[ext] = CacheExtensionStats{
+			CacheEntryStats: cc.entryStats(),
+			Skipped:         cc.skipped.Load(),
+		}
+	}
+
+	return stats
+}
+
+// ext returns the extension of the content, used to group the statistics
+func (s *cacheStorage) ext() string {
+	return filepath.Ext(s.content.Name())
+}
+
+func (c *Cache) dumpStats(sb *strings.Builder) {
+	stats := c.Stats()
+
+	sb.WriteString("\n - Requests: ")
+	writeStats(sb, stats.CacheEntryStats)
+	sb.WriteString(fmt.Sprintf(" - Skipped: %d - Not Found: %d", stats.Skipped, stats.NotFound))
+
+	exts := make([]string, 0, len(stats.Extensions))
+	for ext := range stats.Extensions {
+		exts = append(exts, ext)
+	}
+	slices.Sort(exts)
+
+	for _, ext := range exts {
+		es := stats.Extensions[ext]
+		if ext == "" {
+			ext = "(none)"
+		}
+
+		sb.WriteString("\n   - ")
+		sb.WriteString(ext)
+		sb.WriteString(" -> ")
+		writeStats(sb, es.CacheEntryStats)
+		if es.Skipped != 0 {
+			sb.WriteString(fmt.Sprintf(" - Skipped: %d", es.Skipped))
+		}
+	}
+}
+
+func writeStats(sb *strings.Builder, s CacheEntryStats) {
+	sb.WriteString(fmt.Sprintf("Hits: %d - Misses: %d (%.1f%% hits)", s.Hits, s.Misses, s.HitRatio() * 100))
+	if s.Refreshes != 0 {
+		sb.WriteString(fmt.Sprintf(" - Refreshes: %d", s.Refreshes))
+	}
+	if s.Errors != 0 {
+		sb.WriteString(fmt.Sprintf(" - Errors: %d", s.Errors))
+	}
+	sb.WriteString(" - Served: ")
+	sb.WriteString(utility.PrintBytes(int(s.MemoryBytes)))
+	sb.WriteString(" memory, ")
+	sb.WriteString(utility.PrintBytes(int(s.DiskBytes)))
+	sb.WriteString(" disk")
+}
+
+// statsWriter counts the bytes of the response body. It implements
+// io.ReaderFrom so that the files are still sent with sendfile
+type statsWriter struct {
+	http.ResponseWriter
+	written int64
+}
+
+func (w *statsWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *statsWriter) ReadFrom(r io.Reader) (int64, error) {
+	n, err := io.Copy(w.ResponseWriter, r)
+	w.written += n
+	return n, err
+}
+
+func (w *statsWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
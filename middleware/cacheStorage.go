@@ -3,18 +3,37 @@ package middleware
 import (
 	"errors"
 	"io"
+	"io/fs"
+	"sync"
+	"sync/atomic"
 	"time"
-
-	"github.com/nixpare/broadcaster"
 )
 
+// cacheStorage holds a content and its current version. The versions are
+// never modified once loaded: an update replaces the version atomically,
+// so the readers keep serving the one they started with
 type cacheStorage struct {
-	cache      *Cache
-	data       []byte
-	content    Content
-	info       ContentInfo
-	expiration time.Time
-	bc         *broadcaster.Broadcaster[struct{}]
+	cache       *Cache
+	content     Content
+	version     atomic.Pointer[cacheVersion]
+	expiration  atomic.Int64
+	lastAccess  atomic.Int64
+	stats       cacheCounters
+	updateMutex sync.Mutex
+	updates     atomic.Uint64
+	updateErr   error
+}
+
+// cacheVersion is a snapshot of a content. The buffer is nil when the
+// content is not kept in memory, and the chunks are set when the content
+// is cached in chunks. The entity tag and the variants are set once the
+// buffer is fully loaded
+type cacheVersion struct {
+	info     ContentInfo
+	buf      *cacheBuffer
+	chunks   *cacheChunks
+	variants atomic.Pointer[map[string][]byte]
+	etag     atomic.Pointer[string]
 }
 
 func (c *Cache) NewContent(content Content) error {
@@ -26,7 +45,6 @@ func (c *Cache) newContent(content Content) (*cacheStorage, error) {
 	cs := &cacheStorage{
 		cache: c,
 		content: content,
-		bc: broadcaster.NewBroadcaster[struct{}](),
 	}
 
 	err := cs.update()
@@ -41,65 +59,300 @@ func (c *Cache) newContent(content Content) (*cacheStorage, error) {
 	return cs, nil
 }
 
+// update loads the current version of the content. Only one update runs
+// at a time: the goroutines calling update while another one is running
+// wait for it and share its result instead of loading the content again
 func (s *cacheStorage) update() error {
-	s.expiration = time.Now().Add(s.cache.ttl)
+	updates := s.updates.Load()
+
+	s.updateMutex.Lock()
+	defer s.updateMutex.Unlock()
+
+	if s.updates.Load() != updates {
+		return s.updateErr
+	}
+
+	s.updateErr = s.load()
+	s.updates.Add(1)
+
+	if s.updateErr != nil && !errors.Is(s.updateErr, fs.ErrNotExist) {
+		s.cache.stats.failed(s)
+	}
+	return s.updateErr
+}
+
+func (s *cacheStorage) load() error {
+	s.expiration.Store(time.Now().Add(s.cache.FileCacheTTL()).UnixNano())
 
 	info, err := s.content.Info()
 	if err != nil {
+		if s.cache.backend != nil && errors.Is(err, fs.ErrNotExist) {
+			s.deleteBackend()
+		}
 		return err
 	}
-	if info.Modtime.Compare(s.info.Modtime) <= 0 && info.Size == s.length() {
+
+	old := s.version.Load()
+
+	// The content is loaded again because it has changed or it has been evicted
+	if s.updates.Load() > 0 && (old == nil || info.Modtime.Compare(old.info.Modtime) > 0 || info.Size != old.info.Size) {
+		s.cache.stats.refreshed(s)
+	}
+
+	if s.cache.isChunked(s.content) || !s.cache.memory.fits(info.Size) {
+		v := &cacheVersion{ info: info }
+
+		// The chunks already in memory are kept only if the content
+		// has not changed
+		if s.cache.ranges != nil {
+			if old != nil && old.chunks != nil && old.chunks.matches(info) {
+				v.chunks = old.chunks
+			} else {
+				v.chunks = s.cache.ranges.newChunks(info)
+			}
+		}
+
+		s.version.Store(v)
+		if v.chunks != nil {
+			s.cache.memory.reserveChunks(s, v.chunks)
+		} else {
+			s.cache.memory.release(s)
+		}
+		return nil
+	}
+
+	if old != nil && old.buf != nil && info.Modtime.Compare(old.info.Modtime) <= 0 && info.Size == old.info.Size {
 		return nil
 	}
 
+	if s.usesBackend(info) {
+		if data := s.loadBackend(info); data != nil {
+			v := &cacheVersion{ info: info, buf: loadedBuffer(data) }
+			s.version.Store(v)
+			s.cache.memory.reserve(s, info.Size)
+
+			go s.loaded(v)
+			return nil
+		}
+	}
+
 	reader, err := s.content.Reader()
 	if err != nil {
 		return err
 	}
-	
-	s.info = info
-	if s.data == nil {
-		s.data = make([]byte, 0, info.Size)
-	} else {
-		s.data = s.data[:0]
-	}
 
-	go func() {
-		defer reader.Close()
-		_, _ = io.Copy(s, reader)
-	}()
+	// The version is stored before reserving its memory, so that it is
+	// not evicted while it is being loaded
+	v := &cacheVersion{ info: info, buf: newCacheBuffer(info.Size) }
+	s.version.Store(v)
+	s.cache.memory.reserve(s, info.Size)
 
+	go s.fill(v, reader)
 	return nil
 }
 
-func (s *cacheStorage) length() int {
-	return len(s.data)
+// fill loads the buffer of the version, dropping the version if an
+// error occurs so that the content is loaded again when requested
+func (s *cacheStorage) fill(v *cacheVersion, reader io.ReadCloser) {
+	defer reader.Close()
+
+	_, err := io.Copy(v.buf, reader)
+	if err == nil && !v.buf.full() {
+		err = io.ErrUnexpectedEOF
+	}
+	v.buf.finish(err)
+
+	if err != nil {
+		if s.version.CompareAndSwap(v, nil) {
+			s.cache.memory.release(s)
+		}
+		s.cache.stats.failed(s)
+		s.cache.logger.Printf("error loading content \"%s\": %v\n", s.content.URI(), err)
+		return
+	}
+
+	// The content could have been purged, evicted or reloaded in the
+	// meantime, and its backend entry must not be restored
+	if s.usesBackend(v.info) && s.version.Load() == v {
+		s.storeBackend(v)
+	}
+	s.loaded(v)
 }
 
-func (s *cacheStorage) reader() io.ReadSeeker {
-	return &cacheReader{ cs: s }
+// loaded computes the entity tag and the encoded variants of the version
+// once it has been fully loaded
+func (s *cacheStorage) loaded(v *cacheVersion) {
+	etag := computeETag(v.buf.data)
+	v.etag.Store(&etag)
+
+	if s.cache.compression.enabled() {
+		s.loadVariants(v)
+	}
 }
 
-func (s *cacheStorage) Write(b []byte) (n int, err error) {
-	if len(b) == 0 {
-		return 0, nil
+// loadVariants computes the encoded variants of the version once it has
+// been loaded, accounting them in the memory used
+func (s *cacheStorage) loadVariants(v *cacheVersion) {
+	data := v.buf.bytes()
+	if len(data) == 0 {
+		return
+	}
+
+	variants := s.cache.compression.variants(s, v, data)
+
+	total := len(data)
+	for _, b := range variants {
+		total += len(b)
+	}
+
+	// The content could have been evicted or reloaded in the meantime
+	if s.version.Load() != v {
+		return
 	}
 
-	if len(b) > s.info.Size - s.length() {
-		n = s.info.Size - s.length()
+	v.variants.Store(&variants)
+	s.cache.memory.reserve(s, total)
+}
+
+// expired reports whether the content must be checked for changes
+func (s *cacheStorage) expired() bool {
+	return time.Now().UnixNano() > s.expiration.Load()
+}
+
+// wait waits for the current version to be loaded, returning the error
+// occurred while reading it, if any
+func (s *cacheStorage) wait() error {
+	v := s.version.Load()
+	if v == nil || v.buf == nil {
+		return nil
+	}
+
+	return v.buf.wait()
+}
+
+// length returns the bytes of the version in memory
+func (v *cacheVersion) length() int {
+	if v.buf == nil {
+		return 0
+	}
+	return v.buf.length()
+}
+
+// reader returns a reader of the version, or nil if the version is
+// not in memory
+func (v *cacheVersion) reader() io.ReadSeeker {
+	if v.buf == nil {
+		return nil
+	}
+	return &cacheReader{ buf: v.buf }
+}
+
+// cacheBuffer is the data of a version, allocated once with the size of
+// the content. The bytes are written only once, so the readers can read
+// the ones already written without locking while the others are loaded
+type cacheBuffer struct {
+	data   []byte
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	filled int
+	done   bool
+	err    error
+}
+
+func newCacheBuffer(size int) *cacheBuffer {
+	b := &cacheBuffer{ data: make([]byte, size) }
+	b.cond = sync.NewCond(&b.mutex)
+	return b
+}
+
+// loadedBuffer returns a buffer already loaded with the data
+func loadedBuffer(data []byte) *cacheBuffer {
+	b := &cacheBuffer{ data: data, filled: len(data), done: true }
+	b.cond = sync.NewCond(&b.mutex)
+	return b
+}
+
+// Write is used to implement the io.Writer interface
+func (b *cacheBuffer) Write(p []byte) (n int, err error) {
+	b.mutex.Lock()
+	filled := b.filled
+	b.mutex.Unlock()
+
+	n = copy(b.data[filled:], p)
+	if n < len(p) {
 		err = errors.New("virtual file error: exeeded file size")
-	} else {
-		n = len(b)
 	}
 
-	s.data = append(s.data, b[:n]...)
-	s.bc.Send(struct{}{})
+	b.mutex.Lock()
+	b.filled += n
+	b.cond.Broadcast()
+	b.mutex.Unlock()
 
 	return
 }
 
+// finish marks the buffer as loaded, or failed if err is not nil
+func (b *cacheBuffer) finish(err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.done = true
+	b.err = err
+	b.cond.Broadcast()
+}
+
+// available waits for the bytes after offset to be written, returning
+// the bytes written so far and the error occurred loading the buffer
+func (b *cacheBuffer) available(offset int) (int, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for b.filled <= offset && !b.done {
+		b.cond.Wait()
+	}
+	return b.filled, b.err
+}
+
+// wait waits for the buffer to be loaded
+func (b *cacheBuffer) wait() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for !b.done {
+		b.cond.Wait()
+	}
+	return b.err
+}
+
+func (b *cacheBuffer) length() int {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.filled
+}
+
+func (b *cacheBuffer) full() bool {
+	return b.length() == len(b.data)
+}
+
+// complete reports whether the buffer has been loaded successfully
+func (b *cacheBuffer) complete() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.done && b.err == nil
+}
+
+// bytes returns the data if the buffer has been loaded successfully
+func (b *cacheBuffer) bytes() []byte {
+	if !b.complete() {
+		return nil
+	}
+	return b.data
+}
+
 type cacheReader struct {
-	cs *cacheStorage
+	buf    *cacheBuffer
 	offset int64
 }
 
@@ -109,47 +362,39 @@ func (r *cacheReader) Read(p []byte) (n int, err error) {
 		return 0, nil // Reading no data
 	}
 
-	if int(r.offset) == r.cs.info.Size {
+	if r.offset >= int64(len(r.buf.data)) {
 		return 0, io.EOF // Charet position already off
 	}
 
-	var ch *broadcaster.Channel[struct{}]
-	for len(p) > r.cs.length() - int(r.offset) && r.cs.length() < r.cs.info.Size {
-		if ch == nil {
-			ch = r.cs.bc.Register(20)
-			defer ch.Unregister()
-		}
-
-		_, ok := <- ch.Ch()
-		if !ok {
-			break
+	filled, err := r.buf.available(int(r.offset))
+	if int(r.offset) >= filled {
+		if err == nil {
+			err = io.ErrUnexpectedEOF
 		}
+		return 0, err
 	}
 
-	n = copy(p, r.cs.data[r.offset:])
+	n = copy(p, r.buf.data[r.offset:filled])
 	r.offset += int64(n)
-	if int(r.offset) == r.cs.info.Size {
-		err = io.EOF
-	}
-
-	return
+	return n, nil
 }
 
 // Seek is used to implement the io.Seeker interface
 func (r *cacheReader) Seek(offset int64, whence int) (int64, error) {
 	switch whence {
 	case io.SeekStart:
-		r.offset = offset
 	case io.SeekCurrent:
-		r.offset = int64(r.offset) + offset
+		offset += r.offset
 	case io.SeekEnd:
-		r.offset = int64(r.cs.info.Size) + offset
+		offset += int64(len(r.buf.data))
 	default:
 		return 0, errors.New("virtual file seek: invalid whence")
 	}
 
-	if r.offset < 0 {
+	if offset < 0 {
 		return 0, errors.New("virtual file seek: negative position")
 	}
+
+	r.offset = offset
 	return r.offset, nil
 }
@@ -0,0 +1,148 @@
+package middleware
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	storageTestFiles  = 8
+	storageTestBudget = 32 << 10
+)
+
+// storageTestContent returns the content of the file at the version. The
+// versions of a file have the same size, so that a file replaced between
+// reading its info and opening it is still read consistently
+func storageTestContent(file int, version int) []byte {
+	line := fmt.Sprintf("file %02d version %06d\n", file, version)
+	return bytes.Repeat([]byte(line), 200 + file * 50)
+}
+
+// writeStorageTestFile replaces the file atomically, so that a reader
+// never sees a partial file
+func writeStorageTestFile(t *testing.T, dir string, file int, version int) {
+	tmp := filepath.Join(dir, fmt.Sprintf(".tmp-%d", file))
+	if err := os.WriteFile(tmp, storageTestContent(file, version), 0o644); err != nil {
+		t.Error(err)
+		return
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, fmt.Sprintf("f%d.txt", file))); err != nil {
+		t.Error(err)
+	}
+}
+
+// checkStorageTestBody checks that the body is a whole version of the file
+func checkStorageTestBody(file int, body []byte) error {
+	var f, version int
+	if _, err := fmt.Sscanf(string(body), "file %d version %d\n", &f, &version); err != nil {
+		return fmt.Errorf("invalid body %.40q: %v", body, err)
+	}
+
+	if f != file || !bytes.Equal(body, storageTestContent(file, version)) {
+		return fmt.Errorf("body of file %d is not a whole version (%d bytes)", file, len(body))
+	}
+	return nil
+}
+
+// TestCacheStorageConcurrent serves the contents while they are changed,
+// updated, evicted and while the cache is disabled and enabled again, and
+// it is meant to be run with the race detector
+func TestCacheStorageConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	for i := range storageTestFiles {
+		writeStorageTestFile(t, dir, i, 0)
+	}
+
+	c, err := NewCache(
+		log.New(io.Discard, "", 0), dir, 5 * time.Millisecond, []string{ ".txt" },
+		MemoryBudgetOption(storageTestBudget, EVICTION_LRU),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan struct{})
+	time.AfterFunc(time.Second, func() { close(done) })
+
+	running := func() bool {
+		select {
+		case <-done:
+			return false
+		default:
+			return true
+		}
+	}
+
+	var wg sync.WaitGroup
+
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for running() {
+				file := rand.IntN(storageTestFiles)
+				uri := fmt.Sprintf("/f%d.txt", file)
+
+				w := httptest.NewRecorder()
+				c.ServeContent(w, httptest.NewRequest(http.MethodGet, uri, nil), uri)
+
+				if w.Code != http.StatusOK {
+					t.Errorf("%s: status %d", uri, w.Code)
+					return
+				}
+				if err := checkStorageTestBody(file, w.Body.Bytes()); err != nil {
+					t.Errorf("%s: %v", uri, err)
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for version := 1; running(); version++ {
+			file := rand.IntN(storageTestFiles)
+			writeStorageTestFile(t, dir, file, version)
+
+			// The content is not cached while the cache is disabled
+			// or before being requested
+			c.UpdateContent(fmt.Sprintf("/f%d.txt", file))
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for running() {
+			time.Sleep(20 * time.Millisecond)
+			c.DisableFileCache()
+			time.Sleep(5 * time.Millisecond)
+			c.EnableFileCache()
+		}
+	}()
+
+	wg.Wait()
+
+	status := c.Status()
+	if status.Memory.Used > storageTestBudget {
+		t.Errorf("memory used %d over the budget %d", status.Memory.Used, storageTestBudget)
+	}
+	if status.Memory.Evictions == 0 {
+		t.Error("no content has been evicted")
+	}
+}
@@ -0,0 +1,217 @@
+package middleware
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheWatch collects the paths changed inside the cache directory and
+// applies them in a single batch when no other change is reported for
+// the debounce interval
+type cacheWatch struct {
+	cache    *Cache
+	debounce time.Duration
+	mutex    sync.Mutex
+	pending  map[string]struct{}
+	timer    *time.Timer
+	closer   io.Closer
+}
+
+// WatchOption starts watching the cache directory, see Cache.Watch
+func WatchOption(debounce time.Duration) Option {
+	return func(c *Cache) error {
+		return c.Watch(debounce)
+	}
+}
+
+// Watch starts watching the cache directory for changes: the files
+// modified are reloaded and the ones deleted or renamed are removed from
+// the cache. The changes are applied in a batch after no other change is
+// detected for the debounce interval. On Linux inotify is used, on the
+// other systems the directory is polled
+func (c *Cache) Watch(debounce time.Duration) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.watch != nil {
+		return errors.New("cache watch: already watching")
+	}
+	if c.fsys != nil {
+		return errors.New("cache watch: cannot watch a file system cache")
+	}
+
+	w := &cacheWatch{
+		cache:    c,
+		debounce: debounce,
+		pending:  make(map[string]struct{}),
+	}
+
+	closer, err := watchDir(c.dir, w.notify, c.logger)
+	if err != nil {
+		return fmt.Errorf("cache watch: %w", err)
+	}
+	w.closer = closer
+
+	c.watch = w
+	return nil
+}
+
+// StopWatch stops watching the cache directory
+func (c *Cache) StopWatch() error {
+	c.mutex.Lock()
+	w := c.watch
+	c.watch = nil
+	c.mutex.Unlock()
+
+	if w == nil {
+		return nil
+	}
+
+	w.mutex.Lock()
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	w.mutex.Unlock()
+
+	return w.closer.Close()
+}
+
+func (w *cacheWatch) notify(path string) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	w.pending[path] = struct{}{}
+	if w.timer == nil {
+		w.timer = time.AfterFunc(w.debounce, w.flush)
+	} else {
+		w.timer.Reset(w.debounce)
+	}
+}
+
+func (w *cacheWatch) flush() {
+	w.mutex.Lock()
+	paths := make([]string, 0, len(w.pending))
+	for path := range w.pending {
+		paths = append(paths, path)
+	}
+	clear(w.pending)
+	w.timer = nil
+	w.mutex.Unlock()
+
+	if len(paths) != 0 {
+		w.cache.applyChanges(paths)
+	}
+}
+
+// applyChanges reloads the contents whose file has changed and removes
+// the ones whose file no longer exists. The contents that would now be
+// resolved to a new file (for example "/page" when "page.html" is created
+// beside "page/index.html") are removed, to be loaded again when requested
+func (c *Cache) applyChanges(paths []string) {
+	var reload, deleted []*cacheStorage
+	var removed int
+
+	// A change of a precompressed file reloads the original content
+	if c.compression.precompressed {
+		for _, path := range paths {
+			for _, enc := range c.compression.encoders {
+				if enc.Ext != "" && strings.HasSuffix(path, enc.Ext) {
+					paths = append(paths, strings.TrimSuffix(path, enc.Ext))
+				}
+			}
+		}
+	}
+
+	c.mutex.Lock()
+	for uri, cs := range c.storage {
+		f, ok := cs.content.(cachedFile)
+		if !ok {
+			continue
+		}
+
+		changed := false
+		for _, path := range paths {
+			if f.path == path || strings.HasPrefix(f.path, path + string(filepath.Separator)) {
+				changed = true
+				break
+			}
+		}
+
+		if !changed {
+			for _, path := range paths {
+				if f.path != path && c.resolvesTo(uri, path) {
+					delete(c.storage, uri)
+					c.memory.release(cs)
+					removed++
+					break
+				}
+			}
+			continue
+		}
+
+		if _, err := os.Stat(f.path); errors.Is(err, fs.ErrNotExist) {
+			delete(c.storage, uri)
+			c.memory.release(cs)
+			deleted = append(deleted, cs)
+			removed++
+			continue
+		}
+
+		reload = append(reload, cs)
+	}
+	disabled := c.disabled
+	c.mutex.Unlock()
+
+	// The backend could be remote, so it is updated without
+	// holding the lock, like in purge
+	if c.backend != nil {
+		for _, cs := range deleted {
+			cs.deleteBackend()
+		}
+	}
+
+	if !disabled {
+		for _, cs := range reload {
+			if err := cs.update(); err != nil {
+				c.logger.Printf("cache watch: error reloading \"%s\": %v\n", cs.content.URI(), err)
+				continue
+			}
+
+			// The content itself could be unchanged while its precompressed
+			// files are not, so the variants are computed again
+			if v := cs.version.Load(); c.compression.enabled() && v != nil && v.buf != nil && v.buf.complete() {
+				cs.loadVariants(v)
+			}
+		}
+	}
+
+	if len(reload) != 0 || removed != 0 {
+		c.logger.Printf("cache watch: %d contents reloaded, %d removed\n", len(reload), removed)
+	}
+}
+
+// resolvesTo reports whether the uri could be resolved to the file path,
+// following the rules of ServeStatic
+func (c *Cache) resolvesTo(uri string, path string) bool {
+	rel, err := filepath.Rel(c.dir, path)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return false
+	}
+
+	rel = "/" + filepath.ToSlash(rel)
+	switch {
+	case uri == "/":
+		return rel == "/index.html"
+	case filepath.Ext(uri) != "":
+		return rel == uri
+	default:
+		return rel == uri + ".html" || rel == uri + "/index.html"
+	}
+}
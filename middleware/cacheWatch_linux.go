@@ -0,0 +1,149 @@
+//go:build linux
+
+package middleware
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const inotify_mask = syscall.IN_MODIFY | syscall.IN_CLOSE_WRITE | syscall.IN_ATTRIB |
+	syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_DELETE_SELF |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO | syscall.IN_MOVE_SELF
+
+// inotifyWatcher watches a directory tree with inotify, adding a watch
+// for every directory created inside it
+type inotifyWatcher struct {
+	file   *os.File
+	fd     int
+	dir    string
+	notify func(path string)
+	logger *log.Logger
+	mutex  sync.Mutex
+	paths  map[int32]string
+	done   chan struct{}
+}
+
+func watchDir(dir string, notify func(path string), logger *log.Logger) (io.Closer, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+
+	w := &inotifyWatcher{
+		// The file is non blocking, so reads are handled by the runtime
+		// poller and Close interrupts a pending read
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		fd:     fd,
+		dir:    dir,
+		notify: notify,
+		logger: logger,
+		paths:  make(map[int32]string),
+		done:   make(chan struct{}),
+	}
+
+	if err = w.addTree(dir); err != nil {
+		w.file.Close()
+		return nil, err
+	}
+
+	go w.run()
+	return w, nil
+}
+
+// addTree adds a watch for the directory and all its subdirectories
+func (w *inotifyWatcher) addTree(root string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// The directory could have been removed in the meantime
+			if path != root && errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+
+		if !d.IsDir() {
+			return nil
+		}
+
+		wd, err := syscall.InotifyAddWatch(w.fd, path, inotify_mask)
+		if err != nil {
+			return os.NewSyscallError("inotify_add_watch", err)
+		}
+
+		w.mutex.Lock()
+		w.paths[int32(wd)] = path
+		w.mutex.Unlock()
+
+		return nil
+	})
+}
+
+func (w *inotifyWatcher) run() {
+	defer close(w.done)
+
+	buf := make([]byte, 64 * (syscall.SizeofInotifyEvent + syscall.NAME_MAX + 1))
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				w.logger.Printf("cache watch: inotify read error: %v\n", err)
+			}
+			return
+		}
+
+		for offset := 0; offset + syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset + syscall.SizeofInotifyEvent : offset + syscall.SizeofInotifyEvent + int(event.Len)]
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+
+			w.handle(event, string(bytes.TrimRight(nameBytes, "\x00")))
+		}
+	}
+}
+
+func (w *inotifyWatcher) handle(event *syscall.InotifyEvent, name string) {
+	if event.Mask & syscall.IN_Q_OVERFLOW != 0 {
+		// Some events were lost, everything must be checked
+		w.notify(w.dir)
+		return
+	}
+
+	w.mutex.Lock()
+	dir, ok := w.paths[event.Wd]
+	if event.Mask & syscall.IN_IGNORED != 0 {
+		delete(w.paths, event.Wd)
+	}
+	w.mutex.Unlock()
+
+	if !ok {
+		return
+	}
+
+	path := dir
+	if name != "" {
+		path = filepath.Join(dir, name)
+	}
+
+	if event.Mask & syscall.IN_ISDIR != 0 && event.Mask & (syscall.IN_CREATE | syscall.IN_MOVED_TO) != 0 {
+		if err := w.addTree(path); err != nil {
+			w.logger.Printf("cache watch: error watching \"%s\": %v\n", path, err)
+		}
+	}
+
+	w.notify(path)
+}
+
+func (w *inotifyWatcher) Close() error {
+	err := w.file.Close()
+	<-w.done
+	return err
+}
@@ -0,0 +1,114 @@
+//go:build !linux
+
+package middleware
+
+import (
+	"io"
+	"io/fs"
+	"log"
+	"path/filepath"
+	"time"
+)
+
+const cache_poll_interval = 2 * time.Second
+
+// pollWatcher watches a directory tree by walking it periodically and
+// comparing the modification time and size of the files
+type pollWatcher struct {
+	dir    string
+	notify func(path string)
+	logger *log.Logger
+	files  map[string]fileState
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+type fileState struct {
+	modtime time.Time
+	size    int64
+}
+
+func watchDir(dir string, notify func(path string), logger *log.Logger) (io.Closer, error) {
+	w := &pollWatcher{
+		dir:    dir,
+		notify: notify,
+		logger: logger,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+
+	files, err := w.scan()
+	if err != nil {
+		return nil, err
+	}
+	w.files = files
+
+	go w.run()
+	return w, nil
+}
+
+func (w *pollWatcher) scan() (map[string]fileState, error) {
+	files := make(map[string]fileState)
+	err := filepath.WalkDir(w.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == w.dir {
+				return err
+			}
+			return nil
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+
+		files[path] = fileState{ modtime: info.ModTime(), size: info.Size() }
+		return nil
+	})
+
+	return files, err
+}
+
+func (w *pollWatcher) run() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(cache_poll_interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+		}
+
+		files, err := w.scan()
+		if err != nil {
+			w.logger.Printf("cache watch: scan error: %v\n", err)
+			continue
+		}
+
+		for path, state := range files {
+			if old, ok := w.files[path]; !ok || old != state {
+				w.notify(path)
+			}
+		}
+		for path := range w.files {
+			if _, ok := files[path]; !ok {
+				w.notify(path)
+			}
+		}
+
+		w.files = files
+	}
+}
+
+func (w *pollWatcher) Close() error {
+	close(w.stop)
+	<-w.done
+	return nil
+}
@@ -0,0 +1,155 @@
+package middleware
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// watchTestLog collects the lines logged by the cache
+type watchTestLog struct {
+	mutex sync.Mutex
+	buf   bytes.Buffer
+}
+
+func (l *watchTestLog) Write(p []byte) (int, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.buf.Write(p)
+}
+
+func (l *watchTestLog) lines(prefix string) []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var lines []string
+	for _, line := range strings.Split(l.buf.String(), "\n") {
+		if strings.HasPrefix(line, prefix) {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func serveWatchTest(t *testing.T, c *Cache, uri string) string {
+	t.Helper()
+
+	w := httptest.NewRecorder()
+	c.ServeContent(w, httptest.NewRequest(http.MethodGet, uri, nil), uri)
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s: status %d", uri, w.Code)
+	}
+	return w.Body.String()
+}
+
+func cachedWatchTest(c *Cache) []string {
+	var uris []string
+	for _, content := range c.Status().Contents {
+		uris = append(uris, content.URI)
+	}
+	return uris
+}
+
+// waitWatchTest waits for the number of batches applied by the watcher
+func waitWatchTest(t *testing.T, logs *watchTestLog, batches int) []string {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		lines := logs.lines("cache watch: ")
+		if len(lines) >= batches {
+			return lines
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d batches applied, want %d: %q", len(lines), batches, lines)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestCacheWatch(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, data string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("a.txt", "a v1")
+	write("b.txt", "b")
+	write("c.txt", "c")
+	if err := os.Mkdir(filepath.Join(dir, "page"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	write("page/index.html", "index")
+
+	logs := new(watchTestLog)
+	c, err := NewCache(
+		log.New(logs, "", 0), dir, time.Hour, []string{ ".txt", ".html" },
+		WatchOption(100 * time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.StopWatch() })
+
+	for _, uri := range []string{ "/a.txt", "/b.txt", "/c.txt", "/page" } {
+		serveWatchTest(t, c, uri)
+	}
+
+	// Every change happens within the debounce interval, so they are
+	// applied in a single batch
+	write("a.txt", "a v2 changed")
+	if err := os.Remove(filepath.Join(dir, "b.txt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filepath.Join(dir, "c.txt"), filepath.Join(dir, "d.txt")); err != nil {
+		t.Fatal(err)
+	}
+	// "/page" is now resolved to "page.html" instead of "page/index.html"
+	write("page.html", "page")
+
+	lines := waitWatchTest(t, logs, 1)
+	if lines[0] != "cache watch: 1 contents reloaded, 3 removed" {
+		t.Errorf("batch applied: %q", lines[0])
+	}
+
+	if uris := cachedWatchTest(c); !slices.Equal(uris, []string{ "/a.txt" }) {
+		t.Errorf("cached contents %v, want [/a.txt]", uris)
+	}
+	if got := serveWatchTest(t, c, "/a.txt"); got != "a v2 changed" {
+		t.Errorf("/a.txt served %q after the change", got)
+	}
+	if got := serveWatchTest(t, c, "/page"); got != "page" {
+		t.Errorf("/page served %q, want the new page.html", got)
+	}
+
+	// The directories created later are watched too, once the watcher
+	// has seen them: until then the change is written again
+	if err := os.Mkdir(filepath.Join(dir, "new"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	write("new/e.txt", "e v1")
+	if got := serveWatchTest(t, c, "/new/e.txt"); got != "e v1" {
+		t.Fatalf("/new/e.txt served %q", got)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for serveWatchTest(t, c, "/new/e.txt") != "e v2" {
+		if time.Now().After(deadline) {
+			t.Fatal("/new/e.txt not reloaded after the change")
+		}
+
+		write("new/e.txt", "e v2")
+		time.Sleep(200 * time.Millisecond)
+	}
+}
@@ -1,12 +1,294 @@
 package middleware
 
 import (
+	"bytes"
+	"errors"
+	"html/template"
+	"io"
 	"io/fs"
 	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"time"
 )
 
-func FileServerHandler(root fs.FS) http.HandlerFunc {
-    return func(w http.ResponseWriter, r *http.Request) {
-        
-    }
-}
\ No newline at end of file
+var DefaultIndexFiles = [...]string{ "index.html" }
+
+// DefaultListingTemplate is the template used for directory listings
+// when none is provided. It is executed with a FileServerListing
+var DefaultListingTemplate = template.Must(template.New("listing").Parse(`<!DOCTYPE html>
+<html>
+<head>
+	<meta charset="utf-8">
+	<title>Index of {{ .Path }}</title>
+</head>
+<body>
+	<h1>Index of {{ .Path }}</h1>
+	<ul>
+		{{ if ne .Path "/" }}<li><a href="{{ .Parent }}">../</a></li>{{ end }}
+		{{ range .Entries }}<li><a href="{{ .URL }}">{{ .Name }}{{ if .IsDir }}/{{ end }}</a></li>
+		{{ end }}
+	</ul>
+</body>
+</html>
+`))
+
+// FileServer serves the files of an fs.FS. Paths without an extension
+// are resolved like the Cache does, trying first the ".html" file and then
+// the index file of the directory
+type FileServer struct {
+	root            fs.FS
+	indexFiles      []string
+	listing         *template.Template
+	allowHidden     bool
+	notFoundHandler http.HandlerFunc
+}
+
+// FileServerListing is the data provided to the directory listing template
+type FileServerListing struct {
+	Path    string
+	Parent  string
+	Entries []FileServerEntry
+}
+
+type FileServerEntry struct {
+	Name    string
+	URL     string
+	IsDir   bool
+	Size    int64
+	Modtime time.Time
+}
+
+type FileServerOption func(fsrv *FileServer)
+
+func NewFileServer(root fs.FS, opts ...FileServerOption) *FileServer {
+	fsrv := &FileServer{
+		root:       root,
+		indexFiles: DefaultIndexFiles[:],
+	}
+
+	for _, opt := range opts {
+		opt(fsrv)
+	}
+
+	return fsrv
+}
+
+func FileServerHandler(root fs.FS, opts ...FileServerOption) http.HandlerFunc {
+	return NewFileServer(root, opts...).ServeHTTP
+}
+
+// FileServerIndexOption sets the files served when a directory is requested,
+// in order of preference
+func FileServerIndexOption(names ...string) FileServerOption {
+	return func(fsrv *FileServer) {
+		fsrv.indexFiles = names
+	}
+}
+
+// FileServerListingOption enables the directory listing when a directory has
+// no index file. If t is nil, the DefaultListingTemplate is used
+func FileServerListingOption(t *template.Template) FileServerOption {
+	return func(fsrv *FileServer) {
+		if t == nil {
+			t = DefaultListingTemplate
+		}
+		fsrv.listing = t
+	}
+}
+
+// FileServerHiddenOption allows serving and listing files and directories
+// starting with a dot, which are otherwise handled as not existing
+func FileServerHiddenOption() FileServerOption {
+	return func(fsrv *FileServer) {
+		fsrv.allowHidden = true
+	}
+}
+
+func FileServerNotFoundOption(h http.HandlerFunc) FileServerOption {
+	return func(fsrv *FileServer) {
+		fsrv.notFoundHandler = h
+	}
+}
+
+func (fsrv *FileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "405 method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name, ok := fsrv.cleanPath(r.URL.Path)
+	if !ok {
+		fsrv.notFound(w, r)
+		return
+	}
+
+	info, err := fs.Stat(fsrv.root, name)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		http.Error(w, "500 error retreiving content", http.StatusInternalServerError)
+		return
+	}
+
+	if err == nil && !info.IsDir() {
+		fsrv.serveFile(w, r, name)
+		return
+	}
+
+	if path.Ext(name) == "" && name != "." {
+		if fsrv.serveFile(w, r, name + ".html") {
+			return
+		}
+	}
+
+	if err != nil {
+		fsrv.notFound(w, r)
+		return
+	}
+
+	for _, index := range fsrv.indexFiles {
+		if fsrv.serveFile(w, r, path.Join(name, index)) {
+			return
+		}
+	}
+
+	if fsrv.listing == nil {
+		fsrv.notFound(w, r)
+		return
+	}
+
+	fsrv.serveListing(w, r, name)
+}
+
+// cleanPath converts the request path into a valid fs.FS name, reporting
+// false if the path is not allowed to be served
+func (fsrv *FileServer) cleanPath(p string) (string, bool) {
+	if strings.Contains(p, "\\") || strings.Contains(p, "\x00") {
+		return "", false
+	}
+
+	name := strings.TrimPrefix(path.Clean("/" + p), "/")
+	if name == "" {
+		name = "."
+	}
+
+	if !fs.ValidPath(name) {
+		return "", false
+	}
+
+	if !fsrv.allowHidden && isHidden(name) {
+		return "", false
+	}
+
+	return name, true
+}
+
+// serveFile serves the regular file with the given name, reporting false
+// without writing anything if it does not exist
+func (fsrv *FileServer) serveFile(w http.ResponseWriter, r *http.Request, name string) bool {
+	f, err := fsrv.root.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		return false
+	}
+
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		data, err := io.ReadAll(f)
+		if err != nil {
+			http.Error(w, "500 error retreiving content", http.StatusInternalServerError)
+			return true
+		}
+		content = bytes.NewReader(data)
+	}
+
+	http.ServeContent(w, r, info.Name(), info.ModTime(), content)
+	return true
+}
+
+func (fsrv *FileServer) serveListing(w http.ResponseWriter, r *http.Request, name string) {
+	entries, err := fs.ReadDir(fsrv.root, name)
+	if err != nil {
+		http.Error(w, "500 error retreiving content", http.StatusInternalServerError)
+		return
+	}
+
+	base := r.URL.Path
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+
+	parent := path.Dir(strings.TrimSuffix(base, "/"))
+	if parent != "/" {
+		parent += "/"
+	}
+
+	listing := FileServerListing{ Path: base, Parent: parent }
+	for _, entry := range entries {
+		if !fsrv.allowHidden && strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+
+		u := url.URL{ Path: base + entry.Name() }
+		if entry.IsDir() {
+			u.Path += "/"
+		}
+
+		listing.Entries = append(listing.Entries, FileServerEntry{
+			Name:    entry.Name(),
+			URL:     u.String(),
+			IsDir:   entry.IsDir(),
+			Size:    info.Size(),
+			Modtime: info.ModTime(),
+		})
+	}
+
+	slices.SortFunc(listing.Entries, func(a, b FileServerEntry) int {
+		if a.IsDir != b.IsDir {
+			if a.IsDir {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	var buf bytes.Buffer
+	if err := fsrv.listing.Execute(&buf, listing); err != nil {
+		http.Error(w, "500 error rendering directory listing", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+func (fsrv *FileServer) notFound(w http.ResponseWriter, r *http.Request) {
+	if fsrv.notFoundHandler != nil {
+		fsrv.notFoundHandler(w, r)
+	} else {
+		http.Error(w, "404 not found", http.StatusNotFound)
+	}
+}
+
+// isHidden reports whether any element of the path starts with a dot
+func isHidden(name string) bool {
+	for _, elem := range strings.Split(name, "/") {
+		if strings.HasPrefix(elem, ".") && elem != "." {
+			return true
+		}
+	}
+	return false
+}
@@ -9,14 +9,37 @@ import (
 )
 
 type Nix struct {
-    opts []Option
+    opts        []Option
+    middlewares []Middleware
 }
 
+// HandlerFunc is the signature of every handler served by Nix
+type HandlerFunc func(ctx *Context)
+
+// Middleware wraps the next handler in the chain. The returned handler
+// can run code before and after calling next, or not call it at all
+// to short-circuit the request. Every middleware runs inside the error
+// capture, recovery and logging of the Context, so after next returns
+// the final status code and bytes written can be observed with
+// Context.StatusCode and Context.Written
+type Middleware func(next HandlerFunc) HandlerFunc
+
 func New(opts ...Option) *Nix {
     return &Nix{ opts: opts }
 }
 
-func (n *Nix) Handle(handler func(ctx *Context)) http.HandlerFunc {
+// Use appends the middlewares to the chain: the first middleware
+// provided is the outermost one. The chain is built when the handler
+// is created with Handle, Wrap or WrapFunc, so Use must be called before
+// them to take effect
+func (n *Nix) Use(middlewares ...Middleware) *Nix {
+	n.middlewares = append(n.middlewares, middlewares...)
+	return n
+}
+
+func (n *Nix) Handle(handler HandlerFunc) http.HandlerFunc {
+	handler = chain(handler, n.middlewares)
+
     return func(w http.ResponseWriter, r *http.Request) {
 		ctx := newContext(w, r)
 		defer contextPool.Put(ctx)
@@ -29,6 +52,15 @@ func (n *Nix) Handle(handler func(ctx *Context)) http.HandlerFunc {
 	}
 }
 
+// chain wraps the handler with the middlewares, so that the first
+// one is the first to be executed
+func chain(handler HandlerFunc, middlewares []Middleware) HandlerFunc {
+	for i := len(middlewares)-1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
 func (n *Nix) Wrap(handler http.Handler) http.HandlerFunc {
 	return n.Handle(func(ctx *Context) {
 		handler.ServeHTTP(ctx, ctx.R())
@@ -41,7 +73,7 @@ func (n *Nix) WrapFunc(handler http.HandlerFunc) http.HandlerFunc {
 	})
 }
 
-func NewHandler(handler func(ctx *Context), opts ...Option) http.HandlerFunc {
+func NewHandler(handler HandlerFunc, opts ...Option) http.HandlerFunc {
 	return New(opts...).Handle(handler)
 }
 
@@ -61,12 +93,29 @@ func LoggerOption(l *logger.Logger) Option {
 	}
 }
 
+// AccessLogOption sets the AccessLogger used when logging is enabled,
+// by default PrettyAccessLog is used
+func AccessLogOption(al AccessLogger) Option {
+	return func(ctx *Context) {
+		ctx.SetAccessLogger(al)
+	}
+}
+
 func ErrorTemplateOption(t *template.Template) Option {
 	return func(ctx *Context) {
 		ctx.SetErrorTemplate(t)
 	}
 }
 
+// ProblemJSONOption enables the RFC 9457 problem+json format for captured
+// errors, negotiated with the error template and plain text based on the
+// Accept header of the request
+func ProblemJSONOption() Option {
+	return func(ctx *Context) {
+		ctx.SetProblemJSON(true)
+	}
+}
+
 func EnableLoggingOption() Option {
 	return func(ctx *Context) {
 		ctx.enableLogging = true
@@ -114,3 +163,10 @@ func CacheOption(cache *middleware.Cache) Option {
 		ctx.cache = cache
 	}
 }
+
+// MetricsOption records the metrics of every request in the collector
+func MetricsOption(mc *MetricsCollector) Option {
+	return func(ctx *Context) {
+		ctx.collector = mc
+	}
+}
@@ -0,0 +1,284 @@
+package nix
+
+import (
+	"bufio"
+	"cmp"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	DefaultDurationBuckets = [...]float64{ .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10 }
+	DefaultSizeBuckets     = [...]float64{ 100, 1_000, 10_000, 100_000, 1_000_000, 10_000_000, 100_000_000 }
+)
+
+// MetricsCollector aggregates the metrics of every Context it is attached
+// to (see MetricsOption) and exposes them in the Prometheus text format.
+// The series are labelled by method, status class, host and route, where
+// the host is the custom host set with CustomHostLogOption and the route
+// is the pattern matched by a Router: neither of them are taken from the
+// request to keep the number of series bounded
+type MetricsCollector struct {
+	namespace       string
+	durationBuckets []float64
+	sizeBuckets     []float64
+	mutex           sync.Mutex
+	requests        map[requestLabels]*requestSeries
+	inFlight        map[inFlightLabels]int64
+}
+
+type requestLabels struct {
+	method string
+	status string
+	host   string
+	route  string
+}
+
+type inFlightLabels struct {
+	method string
+	host   string
+}
+
+type requestSeries struct {
+	count    uint64
+	duration histogram
+	size     histogram
+}
+
+type histogram struct {
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+type MetricsCollectorOption func(mc *MetricsCollector)
+
+// NewMetricsCollector creates a new MetricsCollector, where every metric name
+// is prefixed by the namespace (if not empty)
+func NewMetricsCollector(namespace string, opts ...MetricsCollectorOption) *MetricsCollector {
+	mc := &MetricsCollector{
+		namespace:       namespace,
+		durationBuckets: DefaultDurationBuckets[:],
+		sizeBuckets:     DefaultSizeBuckets[:],
+		requests:        make(map[requestLabels]*requestSeries),
+		inFlight:        make(map[inFlightLabels]int64),
+	}
+
+	for _, opt := range opts {
+		opt(mc)
+	}
+
+	return mc
+}
+
+// DurationBucketsOption sets the upper bounds (in seconds) of the request
+// duration histogram buckets
+func DurationBucketsOption(buckets ...float64) MetricsCollectorOption {
+	return func(mc *MetricsCollector) {
+		mc.durationBuckets = slices.Sorted(slices.Values(buckets))
+	}
+}
+
+// SizeBucketsOption sets the upper bounds (in bytes) of the response size
+// histogram buckets
+func SizeBucketsOption(buckets ...float64) MetricsCollectorOption {
+	return func(mc *MetricsCollector) {
+		mc.sizeBuckets = slices.Sorted(slices.Values(buckets))
+	}
+}
+
+// begin records the request as in flight, returning the labels used
+func (mc *MetricsCollector) begin(ctx *Context) inFlightLabels {
+	labels := inFlightLabels{
+		method: metricsMethod(ctx.r.Method),
+		host:   ctx.customHostLog,
+	}
+
+	mc.mutex.Lock()
+	mc.inFlight[labels]++
+	mc.mutex.Unlock()
+
+	return labels
+}
+
+// end records the metrics of the request when it has been served
+func (mc *MetricsCollector) end(ctx *Context, inFlight inFlightLabels) {
+	m := ctx.getMetrics()
+
+	labels := requestLabels{
+		method: inFlight.method,
+		status: statusClass(m.Code),
+		host:   ctx.customHostLog,
+		route:  ctx.Route(),
+	}
+
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+
+	mc.inFlight[inFlight]--
+
+	series := mc.requests[labels]
+	if series == nil {
+		series = &requestSeries{
+			duration: histogram{ buckets: make([]uint64, len(mc.durationBuckets)) },
+			size:     histogram{ buckets: make([]uint64, len(mc.sizeBuckets)) },
+		}
+		mc.requests[labels] = series
+	}
+
+	series.count++
+	series.duration.observe(mc.durationBuckets, m.Duration.Seconds())
+	series.size.observe(mc.sizeBuckets, float64(m.Written))
+}
+
+func (h *histogram) observe(bounds []float64, value float64) {
+	if i, _ := slices.BinarySearch(bounds, value); i < len(bounds) {
+		h.buckets[i]++
+	}
+	h.sum += value
+	h.count++
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format
+func (mc *MetricsCollector) WriteTo(w io.Writer) (int64, error) {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+
+	bw := bufio.NewWriter(w)
+	cw := &countWriter{ w: bw }
+
+	requestKeys := make([]requestLabels, 0, len(mc.requests))
+	for labels := range mc.requests {
+		requestKeys = append(requestKeys, labels)
+	}
+	slices.SortFunc(requestKeys, func(a, b requestLabels) int {
+		return cmp.Or(
+			strings.Compare(a.route, b.route), strings.Compare(a.host, b.host),
+			strings.Compare(a.method, b.method), strings.Compare(a.status, b.status),
+		)
+	})
+
+	name := mc.name("http_requests_total")
+	fmt.Fprintf(cw, "# HELP %s Total number of HTTP requests served.\n# TYPE %s counter\n", name, name)
+	for _, labels := range requestKeys {
+		fmt.Fprintf(cw, "%s{%s} %d\n", name, labels.format(), mc.requests[labels].count)
+	}
+
+	name = mc.name("http_request_duration_seconds")
+	fmt.Fprintf(cw, "# HELP %s Duration of the HTTP requests in seconds.\n# TYPE %s histogram\n", name, name)
+	for _, labels := range requestKeys {
+		mc.requests[labels].duration.writeTo(cw, name, labels.format(), mc.durationBuckets)
+	}
+
+	name = mc.name("http_response_size_bytes")
+	fmt.Fprintf(cw, "# HELP %s Size of the HTTP response bodies in bytes.\n# TYPE %s histogram\n", name, name)
+	for _, labels := range requestKeys {
+		mc.requests[labels].size.writeTo(cw, name, labels.format(), mc.sizeBuckets)
+	}
+
+	inFlightKeys := make([]inFlightLabels, 0, len(mc.inFlight))
+	for labels := range mc.inFlight {
+		inFlightKeys = append(inFlightKeys, labels)
+	}
+	slices.SortFunc(inFlightKeys, func(a, b inFlightLabels) int {
+		return cmp.Or(strings.Compare(a.host, b.host), strings.Compare(a.method, b.method))
+	})
+
+	name = mc.name("http_requests_in_flight")
+	fmt.Fprintf(cw, "# HELP %s Number of HTTP requests being served.\n# TYPE %s gauge\n", name, name)
+	for _, labels := range inFlightKeys {
+		fmt.Fprintf(cw, "%s{method=%s,host=%s} %d\n",
+			name, quoteLabel(labels.method), quoteLabel(labels.host), mc.inFlight[labels],
+		)
+	}
+
+	if cw.err != nil {
+		return cw.n, cw.err
+	}
+	return cw.n, bw.Flush()
+}
+
+func (h *histogram) writeTo(w io.Writer, name string, labels string, bounds []float64) {
+	var cumulative uint64
+	for i, bound := range bounds {
+		cumulative += h.buckets[i]
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels, formatFloat(bound), cumulative)
+	}
+	fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+	fmt.Fprintf(w, "%s_sum{%s} %s\n", name, labels, formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+}
+
+// Handler returns an http.Handler serving the metrics
+func (mc *MetricsCollector) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		mc.WriteTo(w)
+	})
+}
+
+func (mc *MetricsCollector) name(metric string) string {
+	if mc.namespace == "" {
+		return metric
+	}
+	return mc.namespace + "_" + metric
+}
+
+func (labels requestLabels) format() string {
+	return fmt.Sprintf("method=%s,status=%s,host=%s,route=%s",
+		quoteLabel(labels.method), quoteLabel(labels.status),
+		quoteLabel(labels.host), quoteLabel(labels.route),
+	)
+}
+
+var labelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func quoteLabel(value string) string {
+	return `"` + labelReplacer.Replace(value) + `"`
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// metricsMethod returns the method as is if it is a standard one,
+// otherwise OTHER, to prevent the creation of unbounded series
+func metricsMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodConnect,
+		http.MethodOptions, http.MethodTrace:
+		return method
+	default:
+		return "OTHER"
+	}
+}
+
+func statusClass(code int) string {
+	if code < 100 || code > 599 {
+		return "unknown"
+	}
+	return strconv.Itoa(code / 100) + "xx"
+}
+
+type countWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (cw *countWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	cw.err = err
+	return n, err
+}
@@ -0,0 +1,329 @@
+package nix
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Proxy is a reverse proxy to a single destination built once and
+// shared between requests, so that the underlying connections are
+// reused. It is served with Context.ServeProxy, which routes the proxy
+// logs to the Context logger.
+//
+// By default the Host header of the incoming request is preserved and
+// the X-Forwarded-For, X-Forwarded-Host and X-Forwarded-Proto headers
+// are set.
+//
+// Websocket requests are proxied to the same destination, using wss for
+// https destinations. The Origin, Cookie and User-Agent headers and the
+// requested subprotocols are forwarded, along with the headers set with
+// ProxyWebSocketHeadersOption
+type Proxy struct {
+	target          *url.URL
+	transport       http.RoundTripper
+	flushInterval   time.Duration
+	rewriteHost     bool
+	xForwarded      bool
+	forwarded       bool
+	requestHeaders  []headerRule
+	responseHeaders []headerRule
+	tlsConfig       *tls.Config
+	wsDialer        *websocket.Dialer
+	wsHeaders       []string
+	wsSubprotocols  []string
+	http            *httputil.ReverseProxy
+	ws              *wsProxy
+}
+
+// headerRule sets a header, or deletes it if the value is empty
+type headerRule struct {
+	name  string
+	value string
+}
+
+type ProxyOption func(p *Proxy) error
+
+// NewProxy creates a new Proxy to the destination
+func NewProxy(dest string, opts ...ProxyOption) (*Proxy, error) {
+	URL, err := url.Parse(dest)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Proxy{
+		target:     URL,
+		transport:  http.DefaultTransport,
+		xForwarded: true,
+	}
+
+	for _, opt := range opts {
+		if err := opt(p); err != nil {
+			return nil, err
+		}
+	}
+
+	p.http = &httputil.ReverseProxy{
+		Rewrite:        p.rewrite,
+		Transport:      p.transport,
+		FlushInterval:  p.flushInterval,
+		ModifyResponse: p.modifyResponse,
+	}
+
+	p.ws = newWSProxy(p.wsDialer)
+	if p.tlsConfig != nil && p.ws.dialer.TLSClientConfig == nil {
+		p.ws.dialer.TLSClientConfig = p.tlsConfig
+	}
+	p.ws.headers = p.wsHeaders
+	p.ws.subprotocols = p.wsSubprotocols
+	p.ws.requestHeaders = p.requestHeaders
+	p.ws.rewriteHost = p.rewriteHost
+
+	return p, nil
+}
+
+// ProxyTransportOption sets the RoundTripper used to reach the destination,
+// by default http.DefaultTransport is used
+func ProxyTransportOption(rt http.RoundTripper) ProxyOption {
+	return func(p *Proxy) error {
+		p.transport = rt
+		return nil
+	}
+}
+
+// ProxyTimeoutOption sets the timeouts of the transport: dial is the maximum
+// time to establish a connection, responseHeader the maximum time waiting for
+// the response headers and idle the maximum time an unused connection is kept
+// open. A zero value leaves the timeout unchanged. If the transport was replaced
+// with ProxyTransportOption, it must be an *http.Transport
+func ProxyTimeoutOption(dial time.Duration, responseHeader time.Duration, idle time.Duration) ProxyOption {
+	return func(p *Proxy) error {
+		base, ok := p.transport.(*http.Transport)
+		if !ok {
+			return errors.New("proxy timeout option: transport is not an *http.Transport")
+		}
+
+		t := base.Clone()
+		if dial != 0 {
+			t.DialContext = (&net.Dialer{ Timeout: dial, KeepAlive: 30 * time.Second }).DialContext
+		}
+		if responseHeader != 0 {
+			t.ResponseHeaderTimeout = responseHeader
+		}
+		if idle != 0 {
+			t.IdleConnTimeout = idle
+		}
+
+		p.transport = t
+		return nil
+	}
+}
+
+// ProxyTLSOption sets the TLS configuration used to connect to https and
+// wss destinations. If the transport was replaced with ProxyTransportOption,
+// it must be an *http.Transport
+func ProxyTLSOption(cfg *tls.Config) ProxyOption {
+	return func(p *Proxy) error {
+		base, ok := p.transport.(*http.Transport)
+		if !ok {
+			return errors.New("proxy tls option: transport is not an *http.Transport")
+		}
+
+		t := base.Clone()
+		t.TLSClientConfig = cfg
+
+		p.transport = t
+		p.tlsConfig = cfg
+		return nil
+	}
+}
+
+// ProxyWebSocketDialerOption sets the dialer used to connect to the
+// destination for websocket requests. If its TLS configuration is nil,
+// the one set with ProxyTLSOption is used
+func ProxyWebSocketDialerOption(d *websocket.Dialer) ProxyOption {
+	return func(p *Proxy) error {
+		p.wsDialer = d
+		return nil
+	}
+}
+
+// ProxyWebSocketHeadersOption adds the headers of the incoming websocket
+// requests forwarded to the destination
+func ProxyWebSocketHeadersOption(names ...string) ProxyOption {
+	return func(p *Proxy) error {
+		p.wsHeaders = append(p.wsHeaders, names...)
+		return nil
+	}
+}
+
+// ProxyWebSocketSubprotocolsOption restricts the subprotocols requested by
+// the clients that are forwarded to the destination
+func ProxyWebSocketSubprotocolsOption(protocols ...string) ProxyOption {
+	return func(p *Proxy) error {
+		p.wsSubprotocols = append(p.wsSubprotocols, protocols...)
+		return nil
+	}
+}
+
+// ProxyFlushIntervalOption sets the flush interval of the response body,
+// see httputil.ReverseProxy.FlushInterval
+func ProxyFlushIntervalOption(d time.Duration) ProxyOption {
+	return func(p *Proxy) error {
+		p.flushInterval = d
+		return nil
+	}
+}
+
+// ProxyRewriteHostOption sets the Host header of the proxied requests to
+// the host of the destination instead of preserving the incoming one
+func ProxyRewriteHostOption() ProxyOption {
+	return func(p *Proxy) error {
+		p.rewriteHost = true
+		return nil
+	}
+}
+
+// ProxyNoXForwardedOption disables the X-Forwarded-* headers
+func ProxyNoXForwardedOption() ProxyOption {
+	return func(p *Proxy) error {
+		p.xForwarded = false
+		return nil
+	}
+}
+
+// ProxyForwardedOption enables the RFC 7239 Forwarded header, appending
+// the information of the incoming request to the existing ones
+func ProxyForwardedOption() ProxyOption {
+	return func(p *Proxy) error {
+		p.forwarded = true
+		return nil
+	}
+}
+
+// ProxyRequestHeaderOption sets the header of the proxied requests to the
+// value, or removes it if value is empty
+func ProxyRequestHeaderOption(name string, value string) ProxyOption {
+	return func(p *Proxy) error {
+		p.requestHeaders = append(p.requestHeaders, headerRule{ name: name, value: value })
+		return nil
+	}
+}
+
+// ProxyResponseHeaderOption sets the header of the responses to the
+// value, or removes it if value is empty
+func ProxyResponseHeaderOption(name string, value string) ProxyOption {
+	return func(p *Proxy) error {
+		p.responseHeaders = append(p.responseHeaders, headerRule{ name: name, value: value })
+		return nil
+	}
+}
+
+// Target returns the destination of the proxy
+func (p *Proxy) Target() *url.URL {
+	URL := *p.target
+	return &URL
+}
+
+func (p *Proxy) rewrite(pr *httputil.ProxyRequest) {
+	pr.SetURL(p.target)
+	if !p.rewriteHost {
+		pr.Out.Host = pr.In.Host
+	}
+
+	if p.xForwarded {
+		pr.SetXForwarded()
+	}
+
+	if p.forwarded {
+		elem := forwardedElement(pr.In)
+		if prior := pr.In.Header.Values("Forwarded"); len(prior) != 0 {
+			elem = strings.Join(prior, ", ") + ", " + elem
+		}
+		pr.Out.Header.Set("Forwarded", elem)
+	}
+
+	applyHeaderRules(pr.Out.Header, p.requestHeaders)
+}
+
+func (p *Proxy) modifyResponse(r *http.Response) error {
+	if strings.Contains(r.Header.Get("Server"), "PareServer") {
+		r.Header.Del("Server")
+	}
+
+	applyHeaderRules(r.Header, p.responseHeaders)
+	return nil
+}
+
+// ServeProxy proxies the request with the Proxy. Like ReverseProxy, it returns
+// the error occurred during the connection without writing any response.
+// For websocket requests instead, a failed connection to the destination
+// is reported with a 502 error and nil is returned
+func (ctx *Context) ServeProxy(p *Proxy) error {
+	// Shallow copy of the request to use the remote address of the Context
+	r := ctx.r.WithContext(ctx.r.Context())
+	r.RemoteAddr = ctx.RemoteAddr()
+
+	defer func() {
+		if err := recover(); err != nil {
+			ctx.code = http.StatusBadGateway
+			ctx.AddInteralMessage(err)
+		}
+	}()
+
+	if ctx.IsWebSocketRequest() {
+		p.ws.serve(ctx, r, websocketURL(p.target))
+		return nil
+	}
+
+	var returnErr error
+
+	// Shallow copy of the proxy to bind the logs to this Context,
+	// the transport and its connections are still shared
+	httpProxy := *p.http
+	httpProxy.ErrorLog = log.New(ctx.Logger(), fmt.Sprintf("Proxy [%v -> %s] ", ctx.r.URL, p.target), 0)
+	httpProxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		returnErr = fmt.Errorf("http reverse proxy error: %w", err)
+	}
+
+	httpProxy.ServeHTTP(ctx, r)
+	return returnErr
+}
+
+func applyHeaderRules(h http.Header, rules []headerRule) {
+	for _, rule := range rules {
+		if rule.value == "" {
+			h.Del(rule.name)
+		} else {
+			h.Set(rule.name, rule.value)
+		}
+	}
+}
+
+// forwardedElement returns the RFC 7239 forwarded-element describing
+// the incoming request
+func forwardedElement(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+
+	proto := "http"
+	if r.TLS != nil {
+		proto = "https"
+	}
+
+	return fmt.Sprintf("for=%q;host=%q;proto=%s", host, r.Host, proto)
+}
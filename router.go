@@ -0,0 +1,374 @@
+package nix
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// Router dispatches requests to the handlers registered with a
+// method and a pattern. A pattern is made of slash separated segments
+// where each one can be:
+//   - a static value, matched as is
+//   - {name}, matching any single segment
+//   - {name...}, matching all the remaining segments (only as the last one)
+//   - *, the same as {*...}
+//
+// Static segments have priority over parameters, which have priority
+// over wildcards. Captured values are available through Context.Param.
+//
+// Every request served by the Router gets a new Context configured with
+// the Router options, so the 404 and 405 responses go through the same
+// error capture and logging of the registered handlers
+type Router struct {
+	tree        *routeTree
+	prefix      string
+	opts        []Option
+	middlewares []Middleware
+}
+
+type routeTree struct {
+	root     *routeNode
+	opts     []Option
+	notFound HandlerFunc
+}
+
+type routeNode struct {
+	static       map[string]*routeNode
+	param        *routeNode
+	paramName    string
+	wildcard     *routeNode
+	wildcardName string
+	pattern      string
+	routes       map[string]*route
+}
+
+type route struct {
+	handler HandlerFunc
+	opts    []Option
+}
+
+// Param is a value captured from the request path
+type Param struct {
+	Name  string
+	Value string
+}
+
+// methodAny is used to register a handler for every method
+const methodAny = "*"
+
+// NewRouter creates a new Router: the options are applied to every
+// request, even the ones that do not match any route
+func NewRouter(opts ...Option) *Router {
+	return &Router{
+		tree: &routeTree{
+			root: newRouteNode(),
+			opts: opts,
+		},
+	}
+}
+
+func newRouteNode() *routeNode {
+	return &routeNode{ static: make(map[string]*routeNode) }
+}
+
+// Group returns a new Router sharing the same routes, where every
+// pattern is prefixed with the given prefix. Routes registered on the
+// group get the group options and middlewares on top of the ones of
+// the parent
+func (rt *Router) Group(prefix string, opts ...Option) *Router {
+	return &Router{
+		tree:        rt.tree,
+		prefix:      joinPattern(rt.prefix, prefix),
+		opts:        append(slices.Clip(rt.opts), opts...),
+		middlewares: slices.Clip(rt.middlewares),
+	}
+}
+
+// Use appends the middlewares to the ones applied to the routes of the
+// Router. Like for Nix.Use, only routes registered after the call are
+// affected
+func (rt *Router) Use(middlewares ...Middleware) *Router {
+	rt.middlewares = append(rt.middlewares, middlewares...)
+	return rt
+}
+
+// NotFound sets the handler called when no route matches the request
+// path. By default a 404 error is reported with Context.Error
+func (rt *Router) NotFound(handler HandlerFunc) {
+	rt.tree.notFound = handler
+}
+
+// Handle registers the handler for the method and the pattern. It panics
+// if the pattern is invalid or conflicts with an already registered one
+func (rt *Router) Handle(method string, pattern string, handler HandlerFunc) {
+	pattern = joinPattern(rt.prefix, pattern)
+
+	node := rt.tree.root
+	segments := splitPath(pattern)
+	for i, seg := range segments {
+		switch {
+		case seg == "*" || strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "...}"):
+			if i != len(segments)-1 {
+				panic(fmt.Sprintf("router: wildcard must be the last segment in \"%s\"", pattern))
+			}
+
+			name := "*"
+			if seg != "*" {
+				name = strings.TrimSuffix(strings.TrimPrefix(seg, "{"), "...}")
+				if name == "" {
+					panic(fmt.Sprintf("router: empty wildcard name in \"%s\"", pattern))
+				}
+			}
+
+			if node.wildcard == nil {
+				node.wildcard = newRouteNode()
+				node.wildcardName = name
+			} else if node.wildcardName != name {
+				panic(fmt.Sprintf("router: wildcard \"%s\" in \"%s\" conflicts with \"%s\"", name, pattern, node.wildcardName))
+			}
+			node = node.wildcard
+		case strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}"):
+			name := strings.TrimSuffix(strings.TrimPrefix(seg, "{"), "}")
+			if name == "" {
+				panic(fmt.Sprintf("router: empty parameter name in \"%s\"", pattern))
+			}
+
+			if node.param == nil {
+				node.param = newRouteNode()
+				node.paramName = name
+			} else if node.paramName != name {
+				panic(fmt.Sprintf("router: parameter \"%s\" in \"%s\" conflicts with \"%s\"", name, pattern, node.paramName))
+			}
+			node = node.param
+		default:
+			child := node.static[seg]
+			if child == nil {
+				child = newRouteNode()
+				node.static[seg] = child
+			}
+			node = child
+		}
+	}
+
+	method = strings.ToUpper(method)
+	if node.routes == nil {
+		node.routes = make(map[string]*route)
+	}
+	if _, exists := node.routes[method]; exists {
+		panic(fmt.Sprintf("router: handler already registered for %s \"%s\"", method, pattern))
+	}
+
+	node.pattern = pattern
+	node.routes[method] = &route{
+		handler: chain(handler, rt.middlewares),
+		opts:    slices.Clip(rt.opts),
+	}
+}
+
+// Any registers the handler for every method not explicitly registered
+// with the same pattern
+func (rt *Router) Any(pattern string, handler HandlerFunc) {
+	rt.Handle(methodAny, pattern, handler)
+}
+
+func (rt *Router) Get(pattern string, handler HandlerFunc) {
+	rt.Handle(http.MethodGet, pattern, handler)
+}
+
+func (rt *Router) Post(pattern string, handler HandlerFunc) {
+	rt.Handle(http.MethodPost, pattern, handler)
+}
+
+func (rt *Router) Put(pattern string, handler HandlerFunc) {
+	rt.Handle(http.MethodPut, pattern, handler)
+}
+
+func (rt *Router) Patch(pattern string, handler HandlerFunc) {
+	rt.Handle(http.MethodPatch, pattern, handler)
+}
+
+func (rt *Router) Delete(pattern string, handler HandlerFunc) {
+	rt.Handle(http.MethodDelete, pattern, handler)
+}
+
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ctx := newContext(w, r)
+	defer contextPool.Put(ctx)
+
+	for _, opt := range rt.tree.opts {
+		opt(ctx)
+	}
+
+	node := rt.tree.root.match(splitPath(r.URL.EscapedPath()), &ctx.params)
+	if node == nil {
+		ctx.params = ctx.params[:0]
+		if rt.tree.notFound != nil {
+			serveContext(ctx, rt.tree.notFound)
+		} else {
+			serveContext(ctx, func(ctx *Context) {
+				ctx.Error(http.StatusNotFound, "Not found")
+			})
+		}
+		return
+	}
+
+	ctx.route = node.pattern
+
+	route := node.routes[r.Method]
+	if route == nil && r.Method == http.MethodHead {
+		route = node.routes[http.MethodGet]
+	}
+	if route == nil {
+		route = node.routes[methodAny]
+	}
+
+	if route == nil {
+		allow := node.allow()
+		serveContext(ctx, func(ctx *Context) {
+			ctx.Header().Set("Allow", allow)
+			if r.Method == http.MethodOptions {
+				ctx.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			ctx.Error(http.StatusMethodNotAllowed, "Method not allowed")
+		})
+		return
+	}
+
+	for _, opt := range route.opts {
+		opt(ctx)
+	}
+
+	serveContext(ctx, route.handler)
+}
+
+// match returns the node matching the path segments, appending the
+// captured values to params. Static segments are tried first, then
+// parameters and lastly wildcards
+func (node *routeNode) match(segments []string, params *[]Param) *routeNode {
+	if len(segments) == 0 {
+		if node.routes != nil {
+			return node
+		}
+		if node.wildcard != nil && node.wildcard.routes != nil {
+			*params = append(*params, Param{ Name: node.wildcardName })
+			return node.wildcard
+		}
+		return nil
+	}
+
+	seg := segments[0]
+	if child := node.static[seg]; child != nil {
+		if found := child.match(segments[1:], params); found != nil {
+			return found
+		}
+	}
+
+	if node.param != nil && seg != "" {
+		n := len(*params)
+		*params = append(*params, Param{ Name: node.paramName, Value: seg })
+		if found := node.param.match(segments[1:], params); found != nil {
+			return found
+		}
+		*params = (*params)[:n]
+	}
+
+	if node.wildcard != nil && node.wildcard.routes != nil {
+		*params = append(*params, Param{ Name: node.wildcardName, Value: strings.Join(segments, "/") })
+		return node.wildcard
+	}
+
+	return nil
+}
+
+// allow returns the value of the Allow header for the node
+func (node *routeNode) allow() string {
+	methods := make([]string, 0, len(node.routes)+2)
+	for method := range node.routes {
+		if method != methodAny {
+			methods = append(methods, method)
+		}
+	}
+
+	if node.routes[http.MethodGet] != nil && node.routes[http.MethodHead] == nil {
+		methods = append(methods, http.MethodHead)
+	}
+	if node.routes[http.MethodOptions] == nil {
+		methods = append(methods, http.MethodOptions)
+	}
+
+	slices.Sort(methods)
+	return strings.Join(methods, ", ")
+}
+
+// splitPath returns the unescaped segments of the path, ignoring
+// the leading and trailing slash
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+
+	segments := strings.Split(path, "/")
+	for i, seg := range segments {
+		if unescaped, err := url.PathUnescape(seg); err == nil {
+			segments[i] = unescaped
+		}
+	}
+
+	return segments
+}
+
+func joinPattern(prefix string, pattern string) string {
+	return "/" + strings.Trim(strings.TrimRight(prefix, "/") + "/" + strings.TrimLeft(pattern, "/"), "/")
+}
+
+// Param returns the value captured from the request path by the
+// Router for the parameter name. If the Context has no such parameter
+// the main Context is looked up
+func (ctx *Context) Param(name string) string {
+	value, _ := ctx.LookupParam(name)
+	return value
+}
+
+// LookupParam is like Param but also reports if the parameter was found
+func (ctx *Context) LookupParam(name string) (string, bool) {
+	for _, p := range ctx.params {
+		if p.Name == name {
+			return p.Value, true
+		}
+	}
+
+	if main := ctx.Main(); main != nil && main != ctx {
+		return main.LookupParam(name)
+	}
+
+	return "", false
+}
+
+// Params returns all the values captured from the request path
+func (ctx *Context) Params() []Param {
+	if len(ctx.params) == 0 {
+		if main := ctx.Main(); main != nil && main != ctx {
+			return main.Params()
+		}
+	}
+
+	return slices.Clone(ctx.params)
+}
+
+// Route returns the pattern of the route matched by the Router, or an
+// empty string if the request was not served by a Router
+func (ctx *Context) Route() string {
+	if ctx.route == "" {
+		if main := ctx.Main(); main != nil && main != ctx {
+			return main.Route()
+		}
+	}
+
+	return ctx.route
+}
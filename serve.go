@@ -28,6 +28,11 @@ func (ctx *Context) MimeType(mime string) {
 	ctx.Header().Set("Content-Type", mime)
 }
 
+// NewReverseProxy builds a reverse proxy to the destination, returning the
+// handler serving both http and websocket requests. The websocket requests
+// are served like ServeProxy does, reporting a failed connection to the
+// destination with a 502 error: the returned WebsocketProxy is not used by
+// the handler and it is kept only for compatibility
 func (ctx *Context) NewReverseProxy(dest string) (http.Handler, *httputil.ReverseProxy, *websocketproxy.WebsocketProxy, error) {
 	URL, err := url.Parse(dest)
 	if err != nil {
@@ -43,11 +48,8 @@ func (ctx *Context) NewReverseProxy(dest string) (http.Handler, *httputil.Revers
 		return nil
 	}
 
-	wsURL := new(url.URL)
-	*wsURL = *URL
-	wsURL.Scheme = "ws"
-
-    wsProxy := websocketproxy.NewProxy(wsURL)
+	wsURL := websocketURL(URL)
+	ws := newWSProxy(nil)
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
@@ -57,12 +59,16 @@ func (ctx *Context) NewReverseProxy(dest string) (http.Handler, *httputil.Revers
 			}
 		}()
 
-        if ctx.IsWebSocketRequest() {
-            wsProxy.ServeHTTP(w, r)
+        if IsWebSocketRequest(r) {
+			// Shallow copy of the request to use the remote address of the Context
+			r = r.WithContext(r.Context())
+			r.RemoteAddr = ctx.RemoteAddr()
+
+            ws.serve(ctx, r, wsURL)
         } else {
             httpProxy.ServeHTTP(w, r)
         }
-    }), httpProxy, wsProxy, nil
+    }), httpProxy, websocketproxy.NewProxy(wsURL), nil
 }
 
 func (ctx *Context) IsWebSocketRequest() bool {
@@ -79,7 +85,8 @@ func IsWebSocketRequest(r *http.Request) bool {
 }
 
 // ReverseProxy runs a reverse proxy to the provided url. Returns an error is the
-// url could not be parsed or if an error has occurred during the connection
+// url could not be parsed or if an error has occurred during the connection.
+// The proxy is built for each call: to reuse it between requests see Proxy
 func (ctx *Context) ReverseProxy(dest string) error {
 	reverseProxy, httpProxy, _, err := ctx.NewReverseProxy(dest)
 	if err != nil {
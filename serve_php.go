@@ -1,74 +1,846 @@
 package nix
 
 import (
+	"cmp"
+	"errors"
 	"fmt"
-	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/nixpare/logger/v3"
 	"github.com/nixpare/process"
 	"github.com/yookoala/gofast"
 )
 
+var (
+	ErrPHPNotRunning    = errors.New("php processor not running")
+	ErrPHPNoWorkerReady = errors.New("no php worker ready")
+	errPHPWorkerExited  = errors.New("process exited before accepting connections")
+	errPHPNoSlot        = errors.New("no free worker slot")
+)
+
+// PHPProcessor manages a pool of php-cgi workers, each one listening on
+// its own port or unix socket. The FastCGI connections are distributed
+// to the worker with the least active connections, and the number of
+// workers is scaled between the minimum and the maximum to keep the
+// number of idle workers within the configured range.
+// A worker is replaced after serving the configured maximum number of
+// requests: it keeps serving until its replacement is ready, so each
+// worker can have a second slot (port or socket) for its replacement.
+//
+// Workers exiting unexpectedly are restarted with an exponential backoff:
+// after too many consecutive failures the processor is marked as failed
+// and stops restarting them. The lifecycle events are logged with Logger
+// and the state can be inspected with Status
 type PHPProcessor struct {
-	connFactory gofast.ConnFactory
+	// Process is the process of the oldest worker ready, kept after the
+	// workers are stopped.
+	//
+	// Deprecated: the workers are replaced over time and they are started
+	// and stopped by the processor, use Start, Stop and Status instead
 	Process     *process.Process
 	Logger      *logger.Logger
+	execName    string
+	args        []string
+	network     string
+	basePort    int
+	socketDir   string
+	minWorkers  int
+	maxWorkers  int
+	minIdle     int
+	maxIdle     int
+	maxRequests int64
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+	maxFailures int
+	drain       time.Duration
+	mutex       sync.Mutex
+	workers     []*phpWorker
+	slots       []bool
+	running     bool
+	run         int
+	failed      bool
+	failures    int
+	pending     int
+	restarts    int
+	lastExit    *process.ExitStatus
+	lastExitAt  time.Time
+	scale       chan struct{}
+	stop        chan struct{}
+	wg          sync.WaitGroup
+	conns       sync.WaitGroup
+	connFactory gofast.ConnFactory
 }
 
-func NewPHPProcessor(port int, args ...string) (php *PHPProcessor, err error) {
-	php = new(PHPProcessor)
+// PHPState is the state of a PHPProcessor
+type PHPState int
+
+const (
+	PHP_STOPPED PHPState = iota
+	PHP_RUNNING
+	PHP_RESTARTING
+	PHP_FAILED
+)
+
+func (s PHPState) String() string {
+	switch s {
+	case PHP_STOPPED:
+		return "stopped"
+	case PHP_RUNNING:
+		return "running"
+	case PHP_RESTARTING:
+		return "restarting"
+	case PHP_FAILED:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+// PHPStatus is a snapshot of the state of a PHPProcessor: Restarts counts
+// the workers restarted after an unexpected exit, while LastExit is the
+// exit status of the last worker exited, if any
+type PHPStatus struct {
+	State      PHPState
+	Restarts   int
+	LastExit   *process.ExitStatus
+	LastExitAt time.Time
+	Workers    []PHPWorkerStatus
+}
+
+// PHPWorkerStatus is a snapshot of the state of a single worker. Expired
+// reports that the worker served the maximum number of requests and it
+// is waiting for its replacement
+type PHPWorkerStatus struct {
+	Addr     string
+	Ready    bool
+	Expired  bool
+	Retiring bool
+	Active   int64
+	Served   int64
+	Uptime   time.Duration
+}
+
+type phpWorker struct {
+	php      *PHPProcessor
+	slot     int
+	addr     string
+	process  *process.Process
+	ready    atomic.Bool
+	expired  atomic.Bool
+	retiring atomic.Bool
+	active   atomic.Int64
+	served   atomic.Int64
+	started  time.Time
+	exited   chan struct{}
+	exitErr  error
+	stopOnce sync.Once
+	stopErr  error
+}
 
+type PHPOption func(php *PHPProcessor) error
+
+const (
+	php_scale_interval = time.Second
+	php_ready_timeout  = 5 * time.Second
+	// php_stable_after is the uptime after which the exit of a worker
+	// is no longer counted as a consecutive failure
+	php_stable_after   = 30 * time.Second
+)
+
+// NewPHPProcessor creates a PHPProcessor with a single php-cgi worker
+// listening on the given port, started with the provided arguments
+func NewPHPProcessor(port int, args ...string) (*PHPProcessor, error) {
+	return NewPHPPool(
+		PHPPortsOption(port),
+		PHPCommandOption("php-cgi", args...),
+	)
+}
+
+// NewPHPPool creates a PHPProcessor configured with the options. By
+// default a single php-cgi worker is started on port 9000
+func NewPHPPool(opts ...PHPOption) (*PHPProcessor, error) {
+	php := &PHPProcessor{
+		execName:    "php-cgi",
+		network:     "tcp",
+		basePort:    9000,
+		minWorkers:  1,
+		maxWorkers:  1,
+		minBackoff:  100 * time.Millisecond,
+		maxBackoff:  30 * time.Second,
+		maxFailures: 10,
+		drain:       10 * time.Second,
+	}
 	php.Logger = logger.DefaultLogger.Clone(nil, true, "php-cgi")
-	php.Process, err = process.NewProcess(
-		"", "php-cgi",
-		append(
-			[]string{ "-b", fmt.Sprint(port) },
-			process.ParseCommandArgs(args...)...
-		)...)
-	if err != nil {
-		return
+	php.connFactory = php.dial
+
+	for _, opt := range opts {
+		if err := opt(php); err != nil {
+			return nil, err
+		}
 	}
 
-	php.connFactory = gofast.SimpleConnFactory("tcp", fmt.Sprintf(":%d", port))
-	return
+	return php, nil
 }
 
+// PHPCommandOption sets the executable started for each worker and its
+// arguments. The worker is started as "execName -b <address> args...",
+// so any FastCGI responder accepting the same flag can be used
+func PHPCommandOption(execName string, args ...string) PHPOption {
+	return func(php *PHPProcessor) error {
+		php.execName = execName
+		php.args = process.ParseCommandArgs(args...)
+		return nil
+	}
+}
+
+// PHPPortsOption makes the workers listen on TCP ports, starting from
+// basePort up to basePort + 2 * maxWorkers - 1 as the workers replacing
+// the ones recycled are started beside them
+func PHPPortsOption(basePort int) PHPOption {
+	return func(php *PHPProcessor) error {
+		php.network = "tcp"
+		php.basePort = basePort
+		return nil
+	}
+}
+
+// PHPSocketsOption makes the workers listen on unix sockets created
+// in the directory
+func PHPSocketsOption(dir string) PHPOption {
+	return func(php *PHPProcessor) error {
+		abs, err := filepath.Abs(dir)
+		if err != nil {
+			return err
+		}
+
+		php.network = "unix"
+		php.socketDir = abs
+		return nil
+	}
+}
+
+// PHPWorkersOption sets the minimum and maximum number of workers
+func PHPWorkersOption(min int, max int) PHPOption {
+	return func(php *PHPProcessor) error {
+		if min < 1 || max < min {
+			return fmt.Errorf("php workers option: invalid range %d-%d", min, max)
+		}
+
+		php.minWorkers = min
+		php.maxWorkers = max
+		return nil
+	}
+}
+
+// PHPIdleWorkersOption sets the range of idle workers: when there are less
+// idle workers than minIdle new ones are started, and when there are more
+// than maxIdle they are stopped, always within the range of PHPWorkersOption
+func PHPIdleWorkersOption(minIdle int, maxIdle int) PHPOption {
+	return func(php *PHPProcessor) error {
+		if minIdle < 0 || maxIdle < minIdle {
+			return fmt.Errorf("php idle workers option: invalid range %d-%d", minIdle, maxIdle)
+		}
+
+		php.minIdle = minIdle
+		php.maxIdle = maxIdle
+		return nil
+	}
+}
+
+// PHPMaxRequestsOption sets the number of requests after which a worker
+// is replaced. Zero means no limit
+func PHPMaxRequestsOption(n int) PHPOption {
+	return func(php *PHPProcessor) error {
+		php.maxRequests = int64(n)
+		return nil
+	}
+}
+
+// PHPRestartOption sets the backoff between the restarts of the workers
+// exiting unexpectedly, doubling from min up to max, and the number of
+// consecutive failures after which the processor is marked as failed.
+// Zero maxFailures means the workers are always restarted
+func PHPRestartOption(min time.Duration, max time.Duration, maxFailures int) PHPOption {
+	return func(php *PHPProcessor) error {
+		if min <= 0 || max < min {
+			return fmt.Errorf("php restart option: invalid backoff %v-%v", min, max)
+		}
+
+		php.minBackoff = min
+		php.maxBackoff = max
+		php.maxFailures = maxFailures
+		return nil
+	}
+}
+
+// PHPDrainTimeoutOption sets the maximum time Stop waits for the in-flight
+// requests before stopping the workers
+func PHPDrainTimeoutOption(d time.Duration) PHPOption {
+	return func(php *PHPProcessor) error {
+		php.drain = d
+		return nil
+	}
+}
+
+// Start starts the minimum number of workers, waiting for them to accept
+// connections, and the goroutine scaling and recycling the workers
 func (php *PHPProcessor) Start() error {
-	err := php.Process.Start(nil, nil, nil)
-	if err != nil {
+	php.mutex.Lock()
+	if php.running {
+		php.mutex.Unlock()
+		return errors.New("php processor already running")
+	}
+	php.running = true
+	php.run++
+	run := php.run
+	php.failed = false
+	php.failures = 0
+	php.pending = 0
+	php.slots = make([]bool, 2 * php.maxWorkers)
+	php.scale = make(chan struct{}, 1)
+	php.stop = make(chan struct{})
+	php.mutex.Unlock()
+
+	var errs []error
+	for range php.minWorkers {
+		if err := php.spawn(run); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if err := errors.Join(errs...); err != nil {
+		php.Stop()
 		return err
 	}
 
+	php.wg.Add(1)
+	go php.manage(run)
+
+	php.Logger.Printf(logger.LOG_LEVEL_INFO, "php processor started with %d workers", php.minWorkers)
+	return nil
+}
+
+// Stop stops accepting new requests, waits for the in-flight ones up to
+// the drain timeout and then stops every worker, returning the errors
+// of their exit status
+func (php *PHPProcessor) Stop() error {
+	php.mutex.Lock()
+	if !php.running {
+		php.mutex.Unlock()
+		return ErrPHPNotRunning
+	}
+	php.running = false
+	close(php.stop)
+	php.mutex.Unlock()
+
+	php.wg.Wait()
+
+	drained := make(chan struct{})
 	go func() {
-		exitStatus := php.Process.Wait()
-		if err := exitStatus.Error(); err != nil {
-			php.Logger.Print(logger.LOG_LEVEL_ERROR, err)
-		}
+		php.conns.Wait()
+		close(drained)
 	}()
 
+	select {
+	case <-drained:
+	case <-time.After(php.drain):
+		php.Logger.Printf(logger.LOG_LEVEL_WARNING,
+			"php processor stopping with %d requests still in flight",
+			php.activeRequests(),
+		)
+	}
+
+	php.mutex.Lock()
+	workers := slices.Clone(php.workers)
+	php.mutex.Unlock()
+
+	var errs []error
+	for _, w := range workers {
+		if err := w.terminate(); err != nil {
+			errs = append(errs, fmt.Errorf("php worker %s: %w", w.addr, err))
+		}
+	}
+
+	php.Logger.Print(logger.LOG_LEVEL_INFO, "php processor stopped")
+	return errors.Join(errs...)
+}
+
+// Status returns the current state of the processor and its workers
+func (php *PHPProcessor) Status() PHPStatus {
+	php.mutex.Lock()
+	defer php.mutex.Unlock()
+
+	status := PHPStatus{
+		Restarts:   php.restarts,
+		LastExit:   php.lastExit,
+		LastExitAt: php.lastExitAt,
+	}
+
+	switch {
+	case !php.running:
+		status.State = PHP_STOPPED
+	case php.failed:
+		status.State = PHP_FAILED
+	case php.pending > 0:
+		status.State = PHP_RESTARTING
+	default:
+		status.State = PHP_RUNNING
+	}
+
+	for _, w := range php.workers {
+		status.Workers = append(status.Workers, PHPWorkerStatus{
+			Addr:     w.addr,
+			Ready:    w.ready.Load(),
+			Expired:  w.expired.Load(),
+			Retiring: w.retiring.Load(),
+			Active:   w.active.Load(),
+			Served:   w.served.Load(),
+			Uptime:   time.Since(w.started),
+		})
+	}
+
+	return status
+}
+
+// updateProcess sets Process to the oldest worker ready, if any. It must
+// be called with the lock held
+func (php *PHPProcessor) updateProcess() {
+	for _, w := range php.workers {
+		if w.ready.Load() && !w.retiring.Load() {
+			// Assigned only when changed, as it is read without the lock
+			if php.Process != w.process {
+				php.Process = w.process
+			}
+			return
+		}
+	}
+}
+
+func (php *PHPProcessor) activeRequests() (n int64) {
+	php.mutex.Lock()
+	defer php.mutex.Unlock()
+
+	for _, w := range php.workers {
+		n += w.active.Load()
+	}
+	return
+}
+
+// spawn starts a new worker in a free slot and waits for it to be ready.
+// Nothing is started if the processor has been stopped, or restarted,
+// since the given run
+func (php *PHPProcessor) spawn(run int) error {
+	php.mutex.Lock()
+	if !php.running || php.run != run {
+		php.mutex.Unlock()
+		return nil
+	}
+
+	slot := slices.Index(php.slots, false)
+	if slot < 0 {
+		php.mutex.Unlock()
+		return errPHPNoSlot
+	}
+	php.slots[slot] = true
+	php.mutex.Unlock()
+
+	w := &phpWorker{
+		php:    php,
+		slot:   slot,
+		addr:   php.workerAddr(slot),
+		exited: make(chan struct{}),
+	}
+
+	err := w.start()
+	if err != nil {
+		php.release(slot)
+		return fmt.Errorf("php worker %s: %w", w.addr, err)
+	}
+
+	// The worker is added before being ready so that Stop can always
+	// reach it, but it is not selected by dial until then
+	php.mutex.Lock()
+	php.workers = append(php.workers, w)
+	php.mutex.Unlock()
+
+	go php.supervise(w)
+
+	if err := w.waitReady(php_ready_timeout); err != nil {
+		w.terminate()
+		return fmt.Errorf("php worker %s: %w", w.addr, err)
+	}
+
+	php.mutex.Lock()
+	running := php.running && php.run == run
+	if running {
+		php.updateProcess()
+	}
+	php.mutex.Unlock()
+
+	if !running {
+		w.terminate()
+		return nil
+	}
+
+	php.Logger.Printf(logger.LOG_LEVEL_INFO, "php worker %s started", w.addr)
 	return nil
 }
 
-func (php *PHPProcessor) Stop() error {
-	if php.Process.IsRunning() {
-		err := php.Process.Stop()
+// supervise waits for the worker to exit and, if it was not stopped
+// on purpose, records the failure
+func (php *PHPProcessor) supervise(w *phpWorker) {
+	exitStatus := w.process.Wait()
+	w.exitErr = exitStatus.Error()
+	php.remove(w)
+	close(w.exited)
+
+	php.mutex.Lock()
+	defer php.mutex.Unlock()
+
+	php.lastExit = &exitStatus
+	php.lastExitAt = time.Now()
+
+	if w.retiring.Load() || !php.running {
+		php.Logger.Printf(logger.LOG_LEVEL_INFO,
+			"php worker %s stopped after serving %d requests",
+			w.addr, w.served.Load(),
+		)
+		return
+	}
+
+	reason := "exited"
+	if err := exitStatus.Error(); err != nil {
+		reason = fmt.Sprintf("exited with error: %v", err)
+	}
+	php.failure(w.addr, reason, time.Since(w.started))
+}
+
+// failure records a failed worker and schedules a new one after the
+// backoff, unless the maximum number of consecutive failures has been
+// reached. It must be called with the lock held
+func (php *PHPProcessor) failure(addr string, reason string, uptime time.Duration) {
+	if uptime >= php_stable_after {
+		php.failures = 0
+	}
+	php.failures++
+
+	if php.maxFailures > 0 && php.failures > php.maxFailures {
+		php.failed = true
+		php.Logger.Printf(logger.LOG_LEVEL_ERROR,
+			"php worker %s %s: giving up after %d consecutive failures",
+			addr, reason, php.maxFailures,
+		)
+		return
+	}
+
+	backoff := php.minBackoff << (php.failures - 1)
+	if backoff > php.maxBackoff || backoff <= 0 {
+		backoff = php.maxBackoff
+	}
+
+	php.Logger.Printf(logger.LOG_LEVEL_WARNING,
+		"php worker %s %s: restarting in %v",
+		addr, reason, backoff,
+	)
+
+	// The restart is bound to the current run, so that it is dropped
+	// if the processor is stopped and started again in the meantime
+	run := php.run
+	php.pending++
+	time.AfterFunc(backoff, func() { php.restart(run) })
+}
+
+// restart starts the worker replacing a failed one
+func (php *PHPProcessor) restart(run int) {
+	err := php.spawn(run)
+
+	php.mutex.Lock()
+	defer php.mutex.Unlock()
+
+	if !php.running || php.run != run {
+		return
+	}
+	php.pending--
+
+	if err == nil {
+		php.restarts++
+		return
+	}
+
+	// The exit of a worker before being ready is already handled by
+	// supervise, while without a free slot the manager starts it later
+	if !errors.Is(err, errPHPWorkerExited) && !errors.Is(err, errPHPNoSlot) {
+		php.failure("", err.Error(), 0)
+	}
+}
+
+func (php *PHPProcessor) workerAddr(slot int) string {
+	if php.network == "unix" {
+		return filepath.Join(php.socketDir, fmt.Sprintf("php-cgi-%d.sock", slot))
+	}
+	return "127.0.0.1:" + strconv.Itoa(php.basePort + slot)
+}
+
+func (php *PHPProcessor) remove(w *phpWorker) {
+	php.mutex.Lock()
+	php.workers = slices.DeleteFunc(php.workers, func(x *phpWorker) bool { return x == w })
+	php.updateProcess()
+	php.mutex.Unlock()
+
+	php.release(w.slot)
+}
+
+func (php *PHPProcessor) release(slot int) {
+	php.mutex.Lock()
+	php.slots[slot] = false
+	php.mutex.Unlock()
+}
+
+// manage periodically replaces the workers that reached the maximum number
+// of requests and scales the pool based on the idle workers
+func (php *PHPProcessor) manage(run int) {
+	defer php.wg.Done()
+
+	ticker := time.NewTicker(php_scale_interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-php.stop:
+			return
+		case <-ticker.C:
+		case <-php.scale:
+		}
+
+		php.mutex.Lock()
+		workers := slices.Clone(php.workers)
+		pending, failed := php.pending, php.failed
+		php.mutex.Unlock()
+
+		// The failed workers waiting for a restart are counted as running
+		total, ready, idle := pending, 0, 0
+		var idleWorker *phpWorker
+		var expired []*phpWorker
+
+		for _, w := range workers {
+			if w.retiring.Load() {
+				if w.active.Load() == 0 {
+					go w.terminate()
+				}
+				continue
+			}
+
+			// The expired workers keep serving until they are replaced
+			if w.expired.Load() {
+				expired = append(expired, w)
+				continue
+			}
+
+			total++
+			if w.ready.Load() {
+				ready++
+				if w.active.Load() == 0 {
+					idle++
+					idleWorker = w
+				}
+			}
+		}
+
+		if failed {
+			continue
+		}
+
+		switch {
+		case total < php.minWorkers || (idle < php.minIdle && total < php.maxWorkers):
+			err := php.spawn(run)
+			switch {
+			case err == nil:
+				ready++
+				if len(expired) != 0 {
+					php.requestScale()
+				}
+			case errors.Is(err, errPHPNoSlot):
+				php.Logger.Printf(logger.LOG_LEVEL_WARNING, "php processor: cannot start a worker: %v", err)
+			case !errors.Is(err, errPHPWorkerExited):
+				php.mutex.Lock()
+				php.failure("", err.Error(), 0)
+				php.mutex.Unlock()
+			}
+		case idle > php.maxIdle && total > php.minWorkers && idleWorker != nil:
+			idleWorker.retiring.Store(true)
+		}
+
+		if ready >= php.minWorkers {
+			for _, w := range expired {
+				w.retiring.Store(true)
+			}
+		}
+
+		php.mutex.Lock()
+		php.updateProcess()
+		php.mutex.Unlock()
+	}
+}
+
+// dial connects to the worker with the least active connections, preferring
+// the ones not expired and trying the others if the connection fails
+func (php *PHPProcessor) dial() (net.Conn, error) {
+	php.mutex.Lock()
+	if !php.running {
+		php.mutex.Unlock()
+		return nil, ErrPHPNotRunning
+	}
+
+	workers := slices.DeleteFunc(slices.Clone(php.workers), func(w *phpWorker) bool {
+		return !w.ready.Load() || w.retiring.Load()
+	})
+	php.conns.Add(1)
+	php.mutex.Unlock()
+
+	slices.SortStableFunc(workers, func(a, b *phpWorker) int {
+		if ea, eb := a.expired.Load(), b.expired.Load(); ea != eb {
+			if ea {
+				return 1
+			}
+			return -1
+		}
+		return cmp.Compare(a.active.Load(), b.active.Load())
+	})
+
+	if len(workers) == 0 || workers[0].active.Load() != 0 || workers[0].expired.Load() {
+		php.requestScale()
+	}
+
+	err := ErrPHPNoWorkerReady
+	for _, w := range workers {
+		w.active.Add(1)
+
+		var conn net.Conn
+		conn, err = net.Dial(php.network, w.addr)
 		if err != nil {
-			return err
+			w.active.Add(-1)
+			continue
 		}
+
+		return &phpConn{ Conn: conn, worker: w }, nil
 	}
 
-	exitStatus := php.Process.Wait()
-	return exitStatus.Error()
+	php.conns.Done()
+	return nil, err
 }
 
-func (ctx *Context) ServePHP(php *PHPProcessor, dir string) {
-	h := gofast.NewHandler(
-		gofast.NewPHPFS(dir)(gofast.BasicSession),
-		gofast.SimpleClientFactory(php.connFactory),
-	)
+// requestScale wakes up the manager without waiting for the next tick
+func (php *PHPProcessor) requestScale() {
+	select {
+	case php.scale <- struct{}{}:
+	default:
+	}
+}
+
+func (w *phpWorker) start() error {
+	if w.php.network == "unix" {
+		os.Remove(w.addr)
+	}
+
+	p, err := process.NewProcess("", w.php.execName, append([]string{ "-b", w.addr }, w.php.args...)...)
+	if err != nil {
+		return err
+	}
+	w.process = p
+	w.started = time.Now()
+
+	return w.process.Start(nil, nil, nil)
+}
+
+// waitReady waits for the worker to accept connections
+func (w *phpWorker) waitReady(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		conn, err := net.DialTimeout(w.php.network, w.addr, time.Second)
+		if err == nil {
+			conn.Close()
+			w.ready.Store(true)
+			return nil
+		}
+
+		select {
+		case <-w.exited:
+			return errPHPWorkerExited
+		default:
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("not accepting connections: %w", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// terminate stops the worker process and waits for it to exit, returning
+// the error stopping it or, like the single process processor did, the
+// error of its exit status
+func (w *phpWorker) terminate() error {
+	w.retiring.Store(true)
+
+	w.stopOnce.Do(func() {
+		select {
+		case <-w.exited:
+		default:
+			w.stopErr = w.process.Stop()
+			<-w.exited
+		}
+
+		if w.stopErr == nil {
+			w.stopErr = w.exitErr
+		}
 
-	phpLogger := ctx.Logger().Clone(nil, true, "php")
+		if w.php.network == "unix" {
+			os.Remove(w.addr)
+		}
+	})
+
+	return w.stopErr
+}
+
+// phpConn tracks the active connections and the requests served by a worker
+type phpConn struct {
+	net.Conn
+	worker *phpWorker
+	once   sync.Once
+}
+
+func (c *phpConn) Close() error {
+	c.once.Do(func() {
+		w := c.worker
+		w.active.Add(-1)
+		w.php.conns.Done()
+
+		// The worker is retired by the manager once replaced
+		if served := w.served.Add(1); w.php.maxRequests > 0 && served >= w.php.maxRequests {
+			if !w.expired.Swap(true) {
+				w.php.Logger.Printf(logger.LOG_LEVEL_INFO, "php worker %s recycled after %d requests", w.addr, served)
+				w.php.requestScale()
+			}
+		}
+	})
+
+	return c.Conn.Close()
+}
+
+// ServePHP serves the php scripts in dir with the PHPProcessor, see
+// ServeFastCGI for the handling of the errors
+func (ctx *Context) ServePHP(php *PHPProcessor, dir string, opts ...FastCGIOption) error {
+	fcgi, err := newFastCGI(php.connFactory, append([]FastCGIOption{ FastCGIRootOption(dir) }, opts...)...)
+	if err != nil {
+		return err
+	}
 
-	h.SetLogger(log.New(phpLogger, "PHP", 0))
-	h.ServeHTTP(ctx, ctx.R())
+	return ctx.ServeFastCGI(fcgi)
 }
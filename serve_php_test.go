@@ -0,0 +1,260 @@
+package nix
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/fcgi"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// php_test_responder makes the test binary run as a stub FastCGI responder,
+// started by the PHPProcessor as "<test binary> -b <address>"
+const php_test_responder = "NIX_TEST_PHP_RESPONDER"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(php_test_responder) == "1" {
+		runPHPTestResponder()
+		return
+	}
+
+	os.Exit(m.Run())
+}
+
+// runPHPTestResponder answers with the pid of the worker, after waiting
+// for the "ms" query value, and exits after answering with the "exit"
+// query value
+func runPHPTestResponder() {
+	var addr string
+	for i, arg := range os.Args {
+		if arg == "-b" && i + 1 < len(os.Args) {
+			addr = os.Args[i + 1]
+		}
+	}
+
+	network := "tcp"
+	if strings.HasPrefix(addr, "/") {
+		network = "unix"
+	}
+
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	fcgi.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ms, err := strconv.Atoi(r.URL.Query().Get("ms")); err == nil {
+			time.Sleep(time.Duration(ms) * time.Millisecond)
+		}
+		fmt.Fprint(w, os.Getpid())
+
+		if r.URL.Query().Has("exit") {
+			go func() {
+				time.Sleep(20 * time.Millisecond)
+				os.Exit(1)
+			}()
+		}
+	}))
+}
+
+// newPHPTestPool starts a pool of stub responders listening on unix sockets
+func newPHPTestPool(t *testing.T, opts ...PHPOption) *PHPProcessor {
+	t.Setenv(php_test_responder, "1")
+
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	php, err := NewPHPPool(append([]PHPOption{ PHPCommandOption(exe), PHPSocketsOption(t.TempDir()) }, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := php.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { php.Stop() })
+
+	return php
+}
+
+// servePHPTest serves the request with the pool, returning the pid of
+// the worker which served it
+func servePHPTest(php *PHPProcessor, target string) (string, error) {
+	w := httptest.NewRecorder()
+	ctx := newContext(w, httptest.NewRequest(http.MethodGet, target, nil))
+
+	if err := ctx.ServePHP(php, "/srv/www"); err != nil {
+		return "", err
+	}
+	if w.Code != http.StatusOK {
+		return "", fmt.Errorf("status %d: %s", w.Code, w.Body.String())
+	}
+	return w.Body.String(), nil
+}
+
+// waitPHPTest waits for the status of the pool to satisfy cond
+func waitPHPTest(t *testing.T, php *PHPProcessor, what string, cond func(status PHPStatus) bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond(php.Status()) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s: %+v", what, php.Status())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func activePHPTest(status PHPStatus) (n int64) {
+	for _, w := range status.Workers {
+		n += w.Active
+	}
+	return
+}
+
+func TestPHPPoolDistribution(t *testing.T) {
+	php := newPHPTestPool(t, PHPWorkersOption(2, 2))
+
+	type result struct {
+		pid string
+		err error
+	}
+	slow := make(chan result)
+	go func() {
+		pid, err := servePHPTest(php, "/slow.php?ms=300")
+		slow <- result{ pid, err }
+	}()
+
+	waitPHPTest(t, php, "the slow request", func(status PHPStatus) bool {
+		return activePHPTest(status) == 1
+	})
+
+	// The busy worker is skipped
+	pid, err := servePHPTest(php, "/index.php")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res := <-slow
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if pid == res.pid {
+		t.Errorf("both requests served by worker %s", pid)
+	}
+
+	if status := php.Status(); status.State != PHP_RUNNING || len(status.Workers) != 2 {
+		t.Errorf("status %+v, want 2 workers running", status)
+	}
+}
+
+func TestPHPPoolRecycling(t *testing.T) {
+	php := newPHPTestPool(t, PHPWorkersOption(1, 1), PHPMaxRequestsOption(3))
+	first := php.Process
+
+	var pids []string
+	for range 3 {
+		pid, err := servePHPTest(php, "/index.php")
+		if err != nil {
+			t.Fatal(err)
+		}
+		pids = append(pids, pid)
+	}
+	if pids[0] != pids[1] || pids[1] != pids[2] {
+		t.Fatalf("requests served by different workers: %v", pids)
+	}
+
+	waitPHPTest(t, php, "the replacement of the worker", func(status PHPStatus) bool {
+		return len(status.Workers) == 1 && status.Workers[0].Ready &&
+			!status.Workers[0].Expired && status.Workers[0].Served == 0
+	})
+
+	pid, err := servePHPTest(php, "/index.php")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pid == pids[0] {
+		t.Errorf("request served by the recycled worker %s", pid)
+	}
+
+	if status := php.Status(); status.Restarts != 0 {
+		t.Errorf("%d restarts, a recycled worker is not a failure", status.Restarts)
+	}
+	if php.Process == nil || php.Process == first {
+		t.Error("Process not updated to the replacement worker")
+	}
+}
+
+func TestPHPPoolScaling(t *testing.T) {
+	php := newPHPTestPool(t, PHPWorkersOption(1, 3), PHPIdleWorkersOption(1, 1))
+
+	errs := make(chan error, 2)
+	for range 2 {
+		go func() {
+			_, err := servePHPTest(php, "/slow.php?ms=2000")
+			errs <- err
+		}()
+	}
+
+	// Without idle workers new ones are started, up to the maximum
+	waitPHPTest(t, php, "the pool to scale up", func(status PHPStatus) bool {
+		ready := 0
+		for _, w := range status.Workers {
+			if w.Ready && !w.Retiring {
+				ready++
+			}
+		}
+		return ready >= 2
+	})
+
+	for range 2 {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The idle workers over the maximum are stopped, down to the minimum
+	waitPHPTest(t, php, "the pool to scale down", func(status PHPStatus) bool {
+		return len(status.Workers) == 1
+	})
+
+	if _, err := servePHPTest(php, "/index.php"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPHPPoolRestartAfterStop(t *testing.T) {
+	php := newPHPTestPool(t, PHPWorkersOption(1, 1), PHPRestartOption(300 * time.Millisecond, time.Second, 0))
+
+	if _, err := servePHPTest(php, "/index.php?exit"); err != nil {
+		t.Fatal(err)
+	}
+	waitPHPTest(t, php, "the worker restart", func(status PHPStatus) bool {
+		return status.State == PHP_RESTARTING
+	})
+
+	// The restart scheduled before Stop must not start a worker
+	// in the new run
+	if err := php.Stop(); err != nil {
+		t.Fatal(err)
+	}
+	if err := php.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if state := php.Status().State; state != PHP_RUNNING {
+		t.Errorf("state %v after starting again", state)
+	}
+
+	time.Sleep(500 * time.Millisecond)
+	if status := php.Status(); len(status.Workers) != 1 || status.Restarts != 0 {
+		t.Errorf("%d workers and %d restarts, want 1 worker and no restarts", len(status.Workers), status.Restarts)
+	}
+}
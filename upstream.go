@@ -0,0 +1,556 @@
+package nix
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+)
+
+var ErrNoUpstream = errors.New("no upstream available")
+
+// UpstreamPool is a reverse proxy balancing the requests between multiple
+// backends. It is created once and shared between requests, and is served
+// with Context.ProxyUpstream.
+//
+// A backend can be excluded from the balancing by the active health checks
+// (see HealthCheckOption and Start) or, after too many consecutive failures,
+// by the passive ones (see PassiveHealthOption). Requests with an idempotent
+// method and no body are retried on another backend when the connection fails
+type UpstreamPool struct {
+	backends   []*Backend
+	balance    func(pool *UpstreamPool, r *http.Request, exclude []*Backend) *Backend
+	hashKey    func(r *http.Request) string
+	ring       []ringEntry
+	next       atomic.Uint64
+	transport  http.RoundTripper
+	proxy      *httputil.ReverseProxy
+	ws         *wsProxy
+	maxRetries int
+	maxFails   int
+	ejectFor   time.Duration
+	check      *healthCheck
+	stop       chan struct{}
+	wg         sync.WaitGroup
+}
+
+// Backend is a single destination of an UpstreamPool
+type Backend struct {
+	url          *url.URL
+	active       atomic.Int64
+	unhealthy    atomic.Bool
+	fails        atomic.Int32
+	ejectedUntil atomic.Int64
+}
+
+type ringEntry struct {
+	hash    uint32
+	backend *Backend
+}
+
+type healthCheck struct {
+	path     string
+	interval time.Duration
+	timeout  time.Duration
+}
+
+// upstreamRequest is stored in the context of the proxied request
+type upstreamRequest struct {
+	err        error
+	remoteAddr string
+}
+
+type upstreamRequestKey struct{}
+
+// ringReplicas is the number of points of each backend on the
+// consistent hash ring
+const ringReplicas = 100
+
+type UpstreamOption func(pool *UpstreamPool) error
+
+// NewUpstreamPool creates a new pool balancing between the destinations.
+// By default the backends are selected in round-robin
+func NewUpstreamPool(dests []string, opts ...UpstreamOption) (*UpstreamPool, error) {
+	if len(dests) == 0 {
+		return nil, errors.New("upstream pool: no destination provided")
+	}
+
+	pool := &UpstreamPool{
+		balance:   (*UpstreamPool).roundRobin,
+		transport: http.DefaultTransport,
+		stop:      make(chan struct{}),
+	}
+
+	for _, dest := range dests {
+		URL, err := url.Parse(dest)
+		if err != nil {
+			return nil, fmt.Errorf("upstream pool: %w", err)
+		}
+		pool.backends = append(pool.backends, &Backend{ url: URL })
+	}
+
+	for _, opt := range opts {
+		if err := opt(pool); err != nil {
+			return nil, err
+		}
+	}
+
+	pool.proxy = &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			// The destination is chosen by the transport, for each attempt
+			r.URL.Scheme = "http"
+			r.URL.Host = "upstream"
+			if _, ok := r.Header["User-Agent"]; !ok {
+				r.Header.Set("User-Agent", "")
+			}
+		},
+		Transport: upstreamTransport{ pool: pool },
+		ModifyResponse: func(r *http.Response) error {
+			if strings.Contains(r.Header.Get("Server"), "PareServer") {
+				r.Header.Del("Server")
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			if ur, ok := r.Context().Value(upstreamRequestKey{}).(*upstreamRequest); ok {
+				ur.err = fmt.Errorf("http reverse proxy error: %w", err)
+			}
+		},
+	}
+
+	pool.ws = newWSProxy(nil)
+	if t, ok := pool.transport.(*http.Transport); ok {
+		pool.ws.dialer.TLSClientConfig = t.TLSClientConfig
+	}
+
+	return pool, nil
+}
+
+// RoundRobinOption selects the backends in turn
+func RoundRobinOption() UpstreamOption {
+	return func(pool *UpstreamPool) error {
+		pool.balance = (*UpstreamPool).roundRobin
+		return nil
+	}
+}
+
+// LeastConnOption selects the backend with the least active requests
+func LeastConnOption() UpstreamOption {
+	return func(pool *UpstreamPool) error {
+		pool.balance = (*UpstreamPool).leastConn
+		return nil
+	}
+}
+
+// HashHeaderOption selects the backend with a consistent hash of the
+// request header value
+func HashHeaderOption(name string) UpstreamOption {
+	return hashOption(func(r *http.Request) string {
+		return r.Header.Get(name)
+	})
+}
+
+// HashCookieOption selects the backend with a consistent hash of the
+// request cookie value
+func HashCookieOption(name string) UpstreamOption {
+	return hashOption(func(r *http.Request) string {
+		cookie, err := r.Cookie(name)
+		if err != nil {
+			return ""
+		}
+		return cookie.Value
+	})
+}
+
+// HashIPOption selects the backend with a consistent hash of the
+// client IP address, as returned by Context.RemoteAddr
+func HashIPOption() UpstreamOption {
+	return hashOption(func(r *http.Request) string {
+		addr := r.RemoteAddr
+		if ur, ok := r.Context().Value(upstreamRequestKey{}).(*upstreamRequest); ok {
+			addr = ur.remoteAddr
+		}
+
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return addr
+		}
+		return host
+	})
+}
+
+func hashOption(key func(r *http.Request) string) UpstreamOption {
+	return func(pool *UpstreamPool) error {
+		pool.balance = (*UpstreamPool).consistentHash
+		pool.hashKey = key
+
+		pool.ring = pool.ring[:0]
+		for _, b := range pool.backends {
+			for i := range ringReplicas {
+				pool.ring = append(pool.ring, ringEntry{
+					hash:    hashString(b.url.String() + "#" + strconv.Itoa(i)),
+					backend: b,
+				})
+			}
+		}
+		slices.SortFunc(pool.ring, func(a, b ringEntry) int {
+			return cmp.Compare(a.hash, b.hash)
+		})
+
+		return nil
+	}
+}
+
+// HealthCheckOption enables the active health checks, started with Start:
+// every interval a GET request is sent to the path of each backend, which
+// is considered healthy if it responds within the timeout with a status
+// code lower than 500
+func HealthCheckOption(path string, interval time.Duration, timeout time.Duration) UpstreamOption {
+	return func(pool *UpstreamPool) error {
+		if interval <= 0 {
+			return errors.New("upstream pool: invalid health check interval")
+		}
+
+		pool.check = &healthCheck{ path: path, interval: interval, timeout: timeout }
+		return nil
+	}
+}
+
+// PassiveHealthOption excludes a backend for the given duration after
+// maxFails consecutive failed requests. Connection errors and 502, 503
+// and 504 responses are considered failures
+func PassiveHealthOption(maxFails int, ejectFor time.Duration) UpstreamOption {
+	return func(pool *UpstreamPool) error {
+		pool.maxFails = maxFails
+		pool.ejectFor = ejectFor
+		return nil
+	}
+}
+
+// RetryOption sets how many times a failed idempotent request can be
+// retried on another backend
+func RetryOption(maxRetries int) UpstreamOption {
+	return func(pool *UpstreamPool) error {
+		pool.maxRetries = maxRetries
+		return nil
+	}
+}
+
+// UpstreamTransportOption sets the RoundTripper used to reach the backends,
+// by default http.DefaultTransport is used
+func UpstreamTransportOption(rt http.RoundTripper) UpstreamOption {
+	return func(pool *UpstreamPool) error {
+		pool.transport = rt
+		return nil
+	}
+}
+
+// Backends returns the backends of the pool
+func (pool *UpstreamPool) Backends() []*Backend {
+	return slices.Clone(pool.backends)
+}
+
+// Start starts the active health checks, if enabled
+func (pool *UpstreamPool) Start() {
+	if pool.check == nil {
+		return
+	}
+
+	pool.wg.Add(1)
+	go func() {
+		defer pool.wg.Done()
+
+		ticker := time.NewTicker(pool.check.interval)
+		defer ticker.Stop()
+
+		for {
+			pool.checkBackends()
+
+			select {
+			case <-ticker.C:
+			case <-pool.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop stops the active health checks
+func (pool *UpstreamPool) Stop() {
+	select {
+	case <-pool.stop:
+	default:
+		close(pool.stop)
+	}
+	pool.wg.Wait()
+}
+
+func (pool *UpstreamPool) checkBackends() {
+	client := &http.Client{
+		Transport: pool.transport,
+		Timeout:   pool.check.timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	var wg sync.WaitGroup
+	for _, b := range pool.backends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			URL := *b.url
+			URL.Path = singleJoiningSlash(URL.Path, pool.check.path)
+
+			resp, err := client.Get(URL.String())
+			if err != nil {
+				b.unhealthy.Store(true)
+				return
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+
+			b.unhealthy.Store(resp.StatusCode >= 500)
+		}()
+	}
+	wg.Wait()
+}
+
+// ProxyUpstream proxies the request to one of the backends of the pool.
+// Like ReverseProxy, it returns the error occurred during the connection
+// without writing any response. Like ServeProxy, a failed websocket connection
+// is instead reported with a 502 error
+func (ctx *Context) ProxyUpstream(pool *UpstreamPool) error {
+	ur := &upstreamRequest{ remoteAddr: ctx.RemoteAddr() }
+	r := ctx.r.WithContext(context.WithValue(ctx.r.Context(), upstreamRequestKey{}, ur))
+
+	defer func() {
+		if err := recover(); err != nil {
+			ctx.code = http.StatusBadGateway
+			ctx.AddInteralMessage(err)
+		}
+	}()
+
+	if ctx.IsWebSocketRequest() {
+		b := pool.balance(pool, r, nil)
+		if b == nil {
+			return fmt.Errorf("websocket reverse proxy error: %w", ErrNoUpstream)
+		}
+
+		b.active.Add(1)
+		defer b.active.Add(-1)
+
+		err := pool.ws.serve(ctx, r, websocketURL(b.url))
+		pool.reportResult(b, err != nil)
+		return nil
+	}
+
+	pool.proxy.ServeHTTP(ctx, r)
+	return ur.err
+}
+
+func (pool *UpstreamPool) roundRobin(_ *http.Request, exclude []*Backend) *Backend {
+	start := pool.next.Add(1)
+	for i := range uint64(len(pool.backends)) {
+		b := pool.backends[(start + i) % uint64(len(pool.backends))]
+		if b.Available() && !slices.Contains(exclude, b) {
+			return b
+		}
+	}
+	return nil
+}
+
+func (pool *UpstreamPool) leastConn(_ *http.Request, exclude []*Backend) *Backend {
+	var best *Backend
+	for _, b := range pool.backends {
+		if !b.Available() || slices.Contains(exclude, b) {
+			continue
+		}
+		if best == nil || b.active.Load() < best.active.Load() {
+			best = b
+		}
+	}
+	return best
+}
+
+func (pool *UpstreamPool) consistentHash(r *http.Request, exclude []*Backend) *Backend {
+	h := hashString(pool.hashKey(r))
+	start, _ := slices.BinarySearchFunc(pool.ring, h, func(e ringEntry, h uint32) int {
+		return cmp.Compare(e.hash, h)
+	})
+
+	for i := range len(pool.ring) {
+		b := pool.ring[(start + i) % len(pool.ring)].backend
+		if b.Available() && !slices.Contains(exclude, b) {
+			return b
+		}
+	}
+	return nil
+}
+
+// reportResult updates the passive health of the backend
+func (pool *UpstreamPool) reportResult(b *Backend, failed bool) {
+	if !failed {
+		b.fails.Store(0)
+		return
+	}
+
+	if pool.maxFails > 0 && int(b.fails.Add(1)) >= pool.maxFails {
+		b.fails.Store(0)
+		b.ejectedUntil.Store(time.Now().Add(pool.ejectFor).UnixNano())
+	}
+}
+
+type upstreamTransport struct {
+	pool *UpstreamPool
+}
+
+func (t upstreamTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var tried []*Backend
+	var lastErr error
+	for attempt := 0; ; attempt++ {
+		b := t.pool.balance(t.pool, req, tried)
+		if b == nil {
+			if lastErr != nil {
+				return nil, lastErr
+			}
+			return nil, ErrNoUpstream
+		}
+		tried = append(tried, b)
+
+		out := req.Clone(req.Context())
+		out.URL.Scheme = b.url.Scheme
+		out.URL.Host = b.url.Host
+		if b.url.Path != "" {
+			out.URL.Path = singleJoiningSlash(b.url.Path, req.URL.Path)
+			out.URL.RawPath = ""
+		}
+
+		b.active.Add(1)
+		resp, err := t.pool.transport.RoundTrip(out)
+		if err != nil {
+			b.active.Add(-1)
+			t.pool.reportResult(b, true)
+
+			lastErr = fmt.Errorf("upstream %s: %w", b.url.Host, err)
+			if attempt >= t.pool.maxRetries || !isRetryable(req) || req.Context().Err() != nil {
+				return nil, lastErr
+			}
+			continue
+		}
+
+		switch resp.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			t.pool.reportResult(b, true)
+		default:
+			t.pool.reportResult(b, false)
+		}
+
+		body := &upstreamBody{ ReadCloser: resp.Body, backend: b }
+		if rw, ok := resp.Body.(io.ReadWriteCloser); ok && resp.StatusCode == http.StatusSwitchingProtocols {
+			// httputil.ReverseProxy needs a writable body to
+			// copy the upgraded connection
+			resp.Body = upstreamRWBody{ body, rw }
+		} else {
+			resp.Body = body
+		}
+		return resp, nil
+	}
+}
+
+// upstreamBody keeps the backend active until the response is consumed
+type upstreamBody struct {
+	io.ReadCloser
+	backend *Backend
+	once    sync.Once
+}
+
+func (body *upstreamBody) Close() error {
+	body.once.Do(func() {
+		body.backend.active.Add(-1)
+	})
+	return body.ReadCloser.Close()
+}
+
+// upstreamRWBody is the body of an upgraded connection
+type upstreamRWBody struct {
+	*upstreamBody
+	w io.Writer
+}
+
+func (body upstreamRWBody) Write(p []byte) (int, error) {
+	return body.w.Write(p)
+}
+
+// isRetryable reports whether the request can be sent again safely
+func isRetryable(req *http.Request) bool {
+	if req.Body != nil && req.Body != http.NoBody {
+		return false
+	}
+
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions,
+		http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	default:
+		return req.Header.Get("Idempotency-Key") != ""
+	}
+}
+
+// URL returns the destination of the backend
+func (b *Backend) URL() *url.URL {
+	URL := *b.url
+	return &URL
+}
+
+// Healthy reports whether the last active health check succeeded
+func (b *Backend) Healthy() bool {
+	return !b.unhealthy.Load()
+}
+
+// Ejected reports whether the backend is excluded by the passive health checks
+func (b *Backend) Ejected() bool {
+	return time.Now().UnixNano() < b.ejectedUntil.Load()
+}
+
+// Available reports whether the backend can be selected
+func (b *Backend) Available() bool {
+	return b.Healthy() && !b.Ejected()
+}
+
+// ActiveRequests returns the number of requests being served by the backend
+func (b *Backend) ActiveRequests() int64 {
+	return b.active.Load()
+}
+
+func hashString(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+func singleJoiningSlash(a, b string) string {
+	aslash := strings.HasSuffix(a, "/")
+	bslash := strings.HasPrefix(b, "/")
+	switch {
+	case aslash && bslash:
+		return a + b[1:]
+	case !aslash && !bslash:
+		return a + "/" + b
+	}
+	return a + b
+}
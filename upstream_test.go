@@ -0,0 +1,303 @@
+package nix
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// upstreamTestBackend starts a backend answering with its name, unless
+// handler is not nil
+func upstreamTestBackend(t *testing.T, name string, handler http.HandlerFunc) string {
+	if handler == nil {
+		handler = func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(name))
+		}
+	}
+
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// closedBackend returns the address of a backend refusing the connections
+func closedBackend(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	return "http://" + l.Addr().String()
+}
+
+func proxyUpstreamTest(pool *UpstreamPool, r *http.Request) (*httptest.ResponseRecorder, error) {
+	w := httptest.NewRecorder()
+	ctx := newContext(w, r)
+	return w, ctx.ProxyUpstream(pool)
+}
+
+// countUpstreamTest sends n GET requests, returning the number of responses
+// received from each backend
+func countUpstreamTest(t *testing.T, pool *UpstreamPool, n int, header http.Header) map[string]int {
+	t.Helper()
+
+	counts := make(map[string]int)
+	for range n {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		for name, values := range header {
+			r.Header[name] = values
+		}
+
+		w, err := proxyUpstreamTest(pool, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		counts[w.Body.String()]++
+	}
+	return counts
+}
+
+func TestUpstreamRoundRobin(t *testing.T) {
+	pool, err := NewUpstreamPool([]string{
+		upstreamTestBackend(t, "a", nil),
+		upstreamTestBackend(t, "b", nil),
+		upstreamTestBackend(t, "c", nil),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counts := countUpstreamTest(t, pool, 9, nil)
+	for _, name := range []string{ "a", "b", "c" } {
+		if counts[name] != 3 {
+			t.Errorf("backend %s served %d requests, want 3 (%v)", name, counts[name], counts)
+		}
+	}
+}
+
+func TestUpstreamConsistentHash(t *testing.T) {
+	pool, err := NewUpstreamPool([]string{
+		upstreamTestBackend(t, "a", nil),
+		upstreamTestBackend(t, "b", nil),
+		upstreamTestBackend(t, "c", nil),
+	}, HashHeaderOption("X-User"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	used := make(map[string]bool)
+	for i := range 20 {
+		user := "user-" + strings.Repeat("x", i)
+		counts := countUpstreamTest(t, pool, 5, http.Header{ "X-User": { user } })
+		if len(counts) != 1 {
+			t.Fatalf("%s served by more than one backend: %v", user, counts)
+		}
+		for name := range counts {
+			used[name] = true
+		}
+	}
+
+	if len(used) < 2 {
+		t.Errorf("every key served by the same backend: %v", used)
+	}
+}
+
+func TestUpstreamLeastConn(t *testing.T) {
+	release := make(chan struct{})
+	pool, err := NewUpstreamPool([]string{
+		upstreamTestBackend(t, "a", func(w http.ResponseWriter, r *http.Request) {
+			<-release
+			w.Write([]byte("a"))
+		}),
+		upstreamTestBackend(t, "b", nil),
+	}, LeastConnOption())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := pool.Backends()[0]
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := proxyUpstreamTest(pool, httptest.NewRequest(http.MethodGet, "/", nil))
+		done <- err
+	}()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for a.ActiveRequests() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the first request did not reach backend a")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if counts := countUpstreamTest(t, pool, 3, nil); counts["b"] != 3 {
+		t.Errorf("requests not sent to the least loaded backend: %v", counts)
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestUpstreamPassiveEjection(t *testing.T) {
+	var failing atomic.Int32
+	pool, err := NewUpstreamPool([]string{
+		upstreamTestBackend(t, "a", func(w http.ResponseWriter, r *http.Request) {
+			failing.Add(1)
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}),
+		upstreamTestBackend(t, "b", nil),
+	}, PassiveHealthOption(2, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := pool.Backends()[0]
+
+	countUpstreamTest(t, pool, 4, nil)
+	if !a.Ejected() || a.Available() {
+		t.Fatalf("backend a not ejected after %d failures", failing.Load())
+	}
+
+	if counts := countUpstreamTest(t, pool, 4, nil); counts["b"] != 4 {
+		t.Errorf("requests sent to the ejected backend: %v", counts)
+	}
+	if n := failing.Load(); n != 2 {
+		t.Errorf("ejected backend reached %d times, want 2", n)
+	}
+}
+
+func TestUpstreamRetry(t *testing.T) {
+	pool, err := NewUpstreamPool([]string{
+		closedBackend(t),
+		upstreamTestBackend(t, "b", nil),
+	}, RetryOption(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if counts := countUpstreamTest(t, pool, 4, nil); counts["b"] != 4 {
+		t.Errorf("idempotent requests not retried on the other backend: %v", counts)
+	}
+
+	// A request with a body is not retried, so the one sent to the
+	// closed backend fails
+	var failed int
+	for range 2 {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader("body"))
+		if _, err := proxyUpstreamTest(pool, r); err != nil {
+			failed++
+		}
+	}
+	if failed != 1 {
+		t.Errorf("%d requests with a body failed, want 1", failed)
+	}
+}
+
+func TestUpstreamHealthCheck(t *testing.T) {
+	var healthy atomic.Bool
+	pool, err := NewUpstreamPool([]string{
+		upstreamTestBackend(t, "a", func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/health" && !healthy.Load() {
+				w.WriteHeader(http.StatusInternalServerError)
+				return
+			}
+			w.Write([]byte("a"))
+		}),
+		upstreamTestBackend(t, "b", nil),
+	}, HealthCheckOption("/health", 10 * time.Millisecond, time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pool.Start()
+	defer pool.Stop()
+
+	a := pool.Backends()[0]
+	waitUpstreamHealth(t, a, false)
+
+	if counts := countUpstreamTest(t, pool, 4, nil); counts["b"] != 4 {
+		t.Errorf("requests sent to the unhealthy backend: %v", counts)
+	}
+
+	healthy.Store(true)
+	waitUpstreamHealth(t, a, true)
+
+	if counts := countUpstreamTest(t, pool, 4, nil); counts["a"] != 2 || counts["b"] != 2 {
+		t.Errorf("recovered backend not balanced again: %v", counts)
+	}
+}
+
+func waitUpstreamHealth(t *testing.T, b *Backend, healthy bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for b.Healthy() != healthy {
+		if time.Now().After(deadline) {
+			t.Fatalf("backend %s healthy is not %v", b.URL(), healthy)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestUpstreamUpgrade(t *testing.T) {
+	pool, err := NewUpstreamPool([]string{
+		upstreamTestBackend(t, "echo", func(w http.ResponseWriter, r *http.Request) {
+			conn, brw, err := http.NewResponseController(w).Hijack()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer conn.Close()
+
+			brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+			brw.Flush()
+			io.Copy(conn, brw)
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := newContext(w, r).ProxyUpstream(pool); err != nil {
+			t.Error(err)
+		}
+	}))
+	defer srv.Close()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	conn.Write([]byte("GET / HTTP/1.1\r\nHost: upstream\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n"))
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status %d, want %d", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+
+	conn.Write([]byte("ping\n"))
+	line, err := br.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "ping\n" {
+		t.Errorf("echoed %q, want \"ping\\n\"", line)
+	}
+}
@@ -0,0 +1,185 @@
+package nix
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/gorilla/websocket"
+)
+
+// websocketURL returns the websocket endpoint of the destination,
+// mapping http to ws and https to wss
+func websocketURL(u *url.URL) *url.URL {
+	wsURL := new(url.URL)
+	*wsURL = *u
+
+	switch strings.ToLower(u.Scheme) {
+	case "https", "wss":
+		wsURL.Scheme = "wss"
+	default:
+		wsURL.Scheme = "ws"
+	}
+
+	return wsURL
+}
+
+// wsProxy proxies websocket connections to a backend. Failures are
+// reported on the Context instead of being only logged
+type wsProxy struct {
+	dialer         *websocket.Dialer
+	upgrader       *websocket.Upgrader
+	headers        []string
+	subprotocols   []string
+	requestHeaders []headerRule
+	rewriteHost    bool
+}
+
+// newWSProxy creates a websocket proxy using a copy of the dialer,
+// or of websocket.DefaultDialer if nil
+func newWSProxy(dialer *websocket.Dialer) *wsProxy {
+	if dialer == nil {
+		dialer = websocket.DefaultDialer
+	}
+	d := *dialer
+
+	return &wsProxy{
+		dialer: &d,
+		upgrader: &websocket.Upgrader{
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+			// The Origin header is forwarded, the backend is in charge of checking it
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+	}
+}
+
+// serve dials the target and then upgrades the client connection, copying
+// the messages in both directions until one of the two is closed. A failed
+// connection to the backend is reported as a 502 error and returned, any
+// other error is added to the internal messages of the Context
+func (ws *wsProxy) serve(ctx *Context, r *http.Request, target *url.URL) error {
+	backendURL := *target
+	backendURL.Path = singleJoiningSlash(target.Path, r.URL.Path)
+	backendURL.RawPath = ""
+	backendURL.RawQuery = r.URL.RawQuery
+
+	header := http.Header{}
+	for _, name := range append([]string{ "Origin", "Cookie", "User-Agent" }, ws.headers...) {
+		if values := r.Header.Values(name); len(values) != 0 {
+			header[http.CanonicalHeaderKey(name)] = values
+		}
+	}
+
+	protocols := websocket.Subprotocols(r)
+	if ws.subprotocols != nil {
+		protocols = slices.DeleteFunc(protocols, func(p string) bool {
+			return !slices.Contains(ws.subprotocols, p)
+		})
+	}
+	if len(protocols) != 0 {
+		header.Set("Sec-WebSocket-Protocol", strings.Join(protocols, ", "))
+	}
+
+	if !ws.rewriteHost && r.Host != "" {
+		header.Set("Host", r.Host)
+	}
+
+	if clientIP, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := r.Header.Values("X-Forwarded-For"); len(prior) != 0 {
+			clientIP = strings.Join(prior, ", ") + ", " + clientIP
+		}
+		header.Set("X-Forwarded-For", clientIP)
+	}
+	header.Set("X-Forwarded-Host", r.Host)
+	if r.TLS != nil {
+		header.Set("X-Forwarded-Proto", "https")
+	} else {
+		header.Set("X-Forwarded-Proto", "http")
+	}
+
+	applyHeaderRules(header, ws.requestHeaders)
+
+	backend, resp, err := ws.dialer.DialContext(r.Context(), backendURL.String(), header)
+	if err != nil {
+		if resp != nil {
+			resp.Body.Close()
+			err = fmt.Errorf("%w (status %s)", err, resp.Status)
+		}
+
+		err = fmt.Errorf("websocket reverse proxy error: %w", err)
+		ctx.Error(http.StatusBadGateway, "Bad gateway", err)
+		return err
+	}
+	defer backend.Close()
+
+	upgradeHeader := http.Header{}
+	if protocol := resp.Header.Get("Sec-WebSocket-Protocol"); protocol != "" {
+		upgradeHeader.Set("Sec-WebSocket-Protocol", protocol)
+	}
+	for _, cookie := range resp.Header.Values("Set-Cookie") {
+		upgradeHeader.Add("Set-Cookie", cookie)
+	}
+
+	upgrader := *ws.upgrader
+	upgrader.Error = func(w http.ResponseWriter, r *http.Request, status int, reason error) {
+		ctx.Error(status, http.StatusText(status), "websocket upgrade error:", reason)
+	}
+
+	client, err := upgrader.Upgrade(ctx, r, upgradeHeader)
+	if err != nil {
+		return nil
+	}
+	defer client.Close()
+
+	ctx.code = http.StatusSwitchingProtocols
+
+	errClient := make(chan error, 1)
+	errBackend := make(chan error, 1)
+	go copyWebsocket(client, backend, errClient)
+	go copyWebsocket(backend, client, errBackend)
+
+	var direction string
+	select {
+	case err = <-errClient:
+		direction = "backend to client"
+	case err = <-errBackend:
+		direction = "client to backend"
+	}
+
+	var closeErr *websocket.CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code == websocket.CloseAbnormalClosure {
+		ctx.AddInteralMessage(fmt.Sprintf("websocket proxy error copying from %s:", direction), err)
+	}
+
+	return nil
+}
+
+// copyWebsocket copies the messages from src to dst, forwarding the
+// close message when src is closed
+func copyWebsocket(dst *websocket.Conn, src *websocket.Conn, errc chan<- error) {
+	for {
+		msgType, msg, err := src.ReadMessage()
+		if err != nil {
+			m := websocket.FormatCloseMessage(websocket.CloseNormalClosure, err.Error())
+
+			var closeErr *websocket.CloseError
+			if errors.As(err, &closeErr) && closeErr.Code != websocket.CloseNoStatusReceived {
+				m = websocket.FormatCloseMessage(closeErr.Code, closeErr.Text)
+			}
+
+			errc <- err
+			dst.WriteMessage(websocket.CloseMessage, m)
+			return
+		}
+
+		if err = dst.WriteMessage(msgType, msg); err != nil {
+			errc <- err
+			return
+		}
+	}
+}
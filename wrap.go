@@ -1,9 +1,11 @@
 package nix
 
 import (
+	"context"
 	"io"
 	"io/fs"
 	"net/http"
+	"slices"
 	"time"
 
 	"github.com/nixpare/nix/middleware"
@@ -32,6 +34,68 @@ func (ctx *Context) ServeStatic() {
 	ctx.cache.ServeStatic(ctx, ctx.r)
 }
 
+// ResponseCacheMiddleware serves the responses of the next handlers from
+// the response cache, calling them only when there is no fresh response
+// stored (see middleware.ResponseCache)
+func ResponseCacheMiddleware(rc *middleware.ResponseCache) Middleware {
+	return func(next HandlerFunc) HandlerFunc {
+		return func(ctx *Context) {
+			rc.Serve(ctx, ctx.r, ctx.fork(next))
+		}
+	}
+}
+
+// fork returns a handler calling next with a copy of the Context writing to
+// the ResponseWriter provided. The copy is taken immediately, so that the
+// handler can be called even after the request is done, for example to
+// refresh a response in the background: in that case the copy is detached
+// from the main Context, which could already be serving another request.
+// The errors captured by the copy are written as their status code and
+// message, to be captured again by the original Context
+func (ctx *Context) fork(next HandlerFunc) http.Handler {
+	parent, r := ctx, ctx.r
+	template := *ctx
+	template.params = slices.Clone(ctx.params)
+	l, remoteAddr := ctx.Logger(), ctx.RemoteAddr()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		sub := new(Context)
+		*sub = template
+		sub.w = w
+		sub.r = req
+		sub.connTime = time.Now()
+		sub.caputedError = CapturedError{}
+		sub.code = 0
+		sub.written = 0
+		sub.hijacked = false
+		sub.collector = nil
+
+		if req != r {
+			sub.main = nil
+			sub.l = l
+			sub.remoteAddr = remoteAddr
+			sub.r = req.WithContext(context.WithValue(req.Context(), main_nix_context_key, nil))
+		}
+
+		next(sub)
+
+		if sub.code < 400 || !sub.enableErrorCapture {
+			return
+		}
+
+		// The original Context is still serving the same request
+		if req == r {
+			parent.caputedError.internal = append(parent.caputedError.internal, sub.caputedError.internal...)
+			if sub.caputedError.Problem != nil {
+				parent.caputedError.Problem = sub.caputedError.Problem
+			}
+		}
+
+		w.WriteHeader(sub.code)
+		w.Write(sub.caputedError.Data)
+	})
+}
+
 func (ctx *Context) SetCookie(name string, value any, maxAge int, opts ...middleware.CookieOption) error {
 	return ctx.cookieManager.SetCookie(ctx, name, value, maxAge, opts...)
 }
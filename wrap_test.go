@@ -0,0 +1,83 @@
+package nix
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/nixpare/logger/v3"
+	"github.com/nixpare/nix/middleware"
+)
+
+// TestResponseCacheRevalidateDetached checks that a response revalidated
+// in the background, after the request is done, is not bound to the
+// Contexts of the request, which could be serving other requests
+func TestResponseCacheRevalidateDetached(t *testing.T) {
+	c, err := middleware.NewCache(log.New(io.Discard, "", 0), t.TempDir(), time.Minute, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := c.NewResponseCache(middleware.StaleWhileRevalidateOption(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type revalidation struct {
+		main       *Context
+		getMain    *Context
+		remoteAddr string
+		logger     *logger.Logger
+	}
+
+	l := logger.DefaultLogger.Clone(nil, true, "test")
+	release := make(chan struct{})
+	revalidated := make(chan revalidation, 1)
+
+	var calls atomic.Int32
+	inner := New(ConnectToMainOption(), LoggerOption(l)).
+		Use(ResponseCacheMiddleware(rc)).
+		Handle(func(ctx *Context) {
+			if calls.Add(1) == 2 {
+				<-release
+				revalidated <- revalidation{ ctx.main, GetMain(ctx.R()), ctx.RemoteAddr(), ctx.Logger() }
+				ctx.AddInteralMessage("revalidated")
+			}
+
+			ctx.Header().Set("Cache-Control", "max-age=0")
+			ctx.String("ok")
+		})
+	handler := New(MainOption()).WrapFunc(inner)
+
+	for range 2 {
+		r := httptest.NewRequest(http.MethodGet, "/page", nil)
+		r.RemoteAddr = "192.0.2.1:1234"
+
+		w := httptest.NewRecorder()
+		handler(w, r)
+		if w.Body.String() != "ok" {
+			t.Fatalf("body %q", w.Body.String())
+		}
+	}
+
+	// The second request is done and served from the stale response
+	close(release)
+
+	select {
+	case rv := <-revalidated:
+		if rv.main != nil || rv.getMain != nil {
+			t.Error("revalidation bound to the main Context of the request")
+		}
+		if rv.remoteAddr != "192.0.2.1:1234" {
+			t.Errorf("remote address %q", rv.remoteAddr)
+		}
+		if rv.logger != l {
+			t.Error("logger of the request not kept")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("response not revalidated")
+	}
+}